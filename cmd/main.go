@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
 	"github.com/Schwarf/prototype_chat_server/internal/server"
 	"github.com/Schwarf/prototype_chat_server/internal/storage"
 	"github.com/Schwarf/prototype_chat_server/pkg/config"
@@ -10,24 +13,51 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
-	// Load server configuration
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "promote-admin" {
+		promoteAdmin(os.Args[2:])
+		return
+	}
 
-	serverConfig := config.LoadServerConfig()
-	databaseConfig, err := config.LoadDataBaseConfig()
+	// Load server configuration
+	serverConfig, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("Database config could not be loaded")
+		log.Fatalf("Configuration could not be loaded: %v", err)
 	}
+	log.Printf("Effective configuration:\n%s", serverConfig.Redacted())
 
 	// Initialize the database
-	db, err := storage.ConnectToDatabase(databaseConfig)
+	db, err := storage.ConnectToDatabase(&serverConfig.Database)
 	if err != nil {
 		log.Fatalf("Database connection failed: %v", err)
 	}
+	if err := storage.CheckSchema(db); err != nil {
+		log.Fatalf("Database schema is not usable: %v", err)
+	}
 
-	authentication.LoadSecrets()
+	if serverConfig.Server.InviteSecretsFile != "" {
+		inviteCodes, err := authentication.ReadInviteCodes(serverConfig.Server.InviteSecretsFile)
+		if err != nil {
+			log.Fatalf("Invite secrets could not be loaded: %v", err)
+		}
+		if err := db.SeedInvites(inviteCodes); err != nil {
+			log.Fatalf("Invite secrets could not be stored: %v", err)
+		}
+	}
+	if err := authentication.LoadSigningKeys(&serverConfig.Auth); err != nil {
+		log.Fatalf("Signing keys could not be loaded: %v", err)
+	}
+	authentication.ConfigureOIDC(serverConfig.Auth.OIDC)
 
 	// Create and start the server
 	srv := server.NewServer(serverConfig, db)
@@ -47,3 +77,88 @@ func main() {
 
 	fmt.Println("Server stopped gracefully.")
 }
+
+// migrate runs `migrate up|down|status [flags]`, the flags are the same as the server's.
+func migrate(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: %s migrate up|down|status [flags]", os.Args[0])
+	}
+	serverConfig, err := config.Load(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Configuration could not be loaded: %v", err)
+	}
+	db, err := storage.ConnectToDatabase(&serverConfig.Database)
+	if err != nil {
+		log.Fatalf("Database connection failed: %v", err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		versions, err := db.MigrateUp()
+		for _, version := range versions {
+			fmt.Printf("Applied migration %d\n", version)
+		}
+		if err != nil {
+			log.Fatalf("Migrating up failed: %v", err)
+		}
+		if len(versions) == 0 {
+			fmt.Println("Schema is up to date.")
+		}
+	case "down":
+		version, err := db.MigrateDown()
+		if err != nil {
+			log.Fatalf("Migrating down failed: %v", err)
+		}
+		fmt.Printf("Reverted migration %d\n", version)
+	case "status":
+		states, err := db.MigrationStatus()
+		if err != nil {
+			log.Fatalf("Reading the migration status failed: %v", err)
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.Applied() {
+				applied = "applied " + state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", state.Version, state.Name, applied)
+		}
+	default:
+		log.Fatalf("Unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
+
+// promoteAdmin runs `promote-admin <username> [flags]`, it makes a registered client an admin.
+// It is the only way to become one, so that no name in the configuration is claimed by registering it.
+func promoteAdmin(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: %s promote-admin <username> [flags]", os.Args[0])
+	}
+	serverConfig, err := config.Load(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Configuration could not be loaded: %v", err)
+	}
+	db, err := storage.ConnectToDatabase(&serverConfig.Database)
+	if err != nil {
+		log.Fatalf("Database connection failed: %v", err)
+	}
+	defer db.Close()
+	if err := storage.CheckSchema(db); err != nil {
+		log.Fatalf("Database schema is not usable: %v", err)
+	}
+
+	clientID, err := db.GetClientIDByUsername(args[0])
+	if err != nil {
+		log.Fatalf("Client %s could not be found: %v", args[0], err)
+	}
+	if err := db.SetServerRole(clientID, models.RoleAdmin); err != nil {
+		log.Fatalf("Promoting client %s failed: %v", args[0], err)
+	}
+	fmt.Printf("Client %d (%s) is an admin now.\n", clientID, args[0])
+}
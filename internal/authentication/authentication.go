@@ -2,50 +2,66 @@ package authentication
 
 import (
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
-	"log"
+	"github.com/google/uuid"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+)
 
-	"github.com/Schwarf/prototype_chat_server/internal/models"
+var (
+	ErrTokenExpired = errors.New("token expired")
+	ErrInvalidToken = errors.New("invalid token")
 )
 
-var jwtKey = []byte("your_secret_key")
-var secrets map[string]bool
-var registeredClients = make(map[int]models.Client)
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
 
+// Claims identify a client by its ID in the subject claim.
 type Claims struct {
 	Username string `json:"username"`
 	jwt.RegisteredClaims
 }
 
-func LoadSecrets() {
-	filename := "/home/andreas/Documents/chat_secrets/secrets.txt"
+func (claims *Claims) ClientID() (int, error) {
+	clientID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return clientID, nil
+}
+
+// ReadInviteCodes reads one invite code per line, used to seed invites before any admin exists.
+func ReadInviteCodes(filename string) ([]string, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("Failed to load secrets: %v", err)
+		return nil, err
 	}
 
-	secrets = make(map[string]bool)
+	var codes []string
 	lines := strings.Split(string(data), "\n")
 	for _, line := range lines {
-		secret := strings.TrimSpace(line)
-		if secret != "" {
-			secrets[secret] = true
+		code := strings.TrimSpace(line)
+		if code != "" {
+			codes = append(codes, code)
 		}
 	}
+	return codes, nil
 }
 
-func IsSecretValid(secret string) bool {
-	return secrets[secret]
-}
-
-func RemoveSecret(secret string) {
-	delete(secrets, secret)
+// GenerateInviteCode returns a random code that is hard to guess.
+func GenerateInviteCode() (string, error) {
+	code := make([]byte, 16)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(code), nil
 }
 
 func IsAlphaNumeric(s string) bool {
@@ -57,31 +73,51 @@ func IsAlphaNumeric(s string) bool {
 	return true
 }
 
-func GenerateHash(message string, salt string) string {
-	data := message + salt
-	hash := sha256.New()
-	hash.Write([]byte(data))
-	hashBytes := hash.Sum(nil)
-	hashString := hex.EncodeToString(hashBytes)
-	return hashString
-}
-
-func GenerateToken(username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateToken issues a short-lived access token with a unique ID that can be revoked.
+func GenerateToken(clientID int, username string) (string, error) {
+	expirationTime := time.Now().Add(accessTokenTTL)
 	claims := &Claims{
 		Username: username,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   strconv.Itoa(clientID),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	return signToken(claims)
 }
 
-func RegisterClient(clientID int, client models.Client) {
-	registeredClients[clientID] = client
+// ParseToken verifies the token's signature, expiry and revocation. Expired tokens yield
+// ErrTokenExpired, revoked ones ErrTokenRevoked, every other problem ErrInvalidToken.
+func ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired())
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrTokenExpired
+	}
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	if _, err := claims.ClientID(); err != nil {
+		return nil, err
+	}
+	if IsTokenRevoked(claims.ID) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// ClaimsFromContext returns the claims AuthMiddleware stored for the request.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
 }
 
+// AuthMiddleware rejects requests without a valid bearer token and hands the token's claims
+// to the next handler through the request context.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -92,17 +128,24 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := ParseToken(tokenString)
+		if errors.Is(err, ErrTokenExpired) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token expired"`)
+			http.Error(w, "Token expired", http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, ErrTokenRevoked) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token revoked"`)
+			http.Error(w, "Token revoked", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "username", claims.Username)
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,187 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/pkg/config"
+	"github.com/golang-jwt/jwt/v5"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+)
+
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	// signKey is nil for keys that only verify tokens
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+var signingKeys = make(map[string]*signingKey)
+var activeKey *signingKey
+var signingKeysMutex sync.RWMutex
+
+// LoadSigningKeys replaces the signing keys with the configured ones. Without any configured key
+// a random HS256 key is generated, so tokens do not survive a restart.
+func LoadSigningKeys(authConfig *config.AuthConfig) error {
+	keys := make(map[string]*signingKey)
+	for _, keyConfig := range authConfig.Keys {
+		key, err := loadSigningKey(keyConfig)
+		if err != nil {
+			return fmt.Errorf("signing key %q: %w", keyConfig.ID, err)
+		}
+		if _, duplicate := keys[key.id]; duplicate {
+			return fmt.Errorf("signing key %q is configured twice", key.id)
+		}
+		keys[key.id] = key
+	}
+
+	active := keys[authConfig.ActiveKeyID]
+	if len(keys) == 0 {
+		log.Println("No signing keys configured, generating a temporary key. Issued tokens become invalid on restart!")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		active = &signingKey{id: "temporary", method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+		keys[active.id] = active
+	}
+	if active == nil {
+		return fmt.Errorf("active signing key %q is not configured", authConfig.ActiveKeyID)
+	}
+	if active.signKey == nil {
+		return fmt.Errorf("active signing key %q has no private key", active.id)
+	}
+
+	signingKeysMutex.Lock()
+	defer signingKeysMutex.Unlock()
+	signingKeys = keys
+	activeKey = active
+	return nil
+}
+
+func loadSigningKey(keyConfig config.SigningKeyConfig) (*signingKey, error) {
+	if keyConfig.ID == "" {
+		return nil, fmt.Errorf("missing kid")
+	}
+	key := &signingKey{id: keyConfig.ID}
+	switch keyConfig.Algorithm {
+	case "HS256":
+		if len(keyConfig.Secret) < 32 {
+			return nil, fmt.Errorf("HS256 secrets need at least 32 characters")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = []byte(keyConfig.Secret)
+		key.verifyKey = key.signKey
+	case "RS256", "EdDSA":
+		if keyConfig.Algorithm == "RS256" {
+			key.method = jwt.SigningMethodRS256
+		} else {
+			key.method = jwt.SigningMethodEdDSA
+		}
+		if keyConfig.PrivateKeyFile != "" {
+			privateKey, err := readPrivateKey(keyConfig.Algorithm, keyConfig.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = privateKey.Public()
+		} else if keyConfig.PublicKeyFile != "" {
+			publicKey, err := readPublicKey(keyConfig.Algorithm, keyConfig.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = publicKey
+		} else {
+			return nil, fmt.Errorf("%s keys need a privateKeyFile or publicKeyFile", keyConfig.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", keyConfig.Algorithm)
+	}
+	return key, nil
+}
+
+func readPrivateKey(algorithm string, filename string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == "RS256" {
+		return jwt.ParseRSAPrivateKeyFromPEM(data)
+	}
+	privateKey, err := jwt.ParseEdPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey.(crypto.Signer), nil
+}
+
+func readPublicKey(algorithm string, filename string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == "RS256" {
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	}
+	return jwt.ParseEdPublicKeyFromPEM(data)
+}
+
+// signToken signs the token with the active key and names that key in the kid header.
+func signToken(claims jwt.Claims) (string, error) {
+	signingKeysMutex.RLock()
+	key := activeKey
+	signingKeysMutex.RUnlock()
+	if key == nil {
+		return "", fmt.Errorf("no signing key loaded")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.signKey)
+}
+
+// verificationKey is the jwt.Keyfunc that picks the key named in the token's kid header.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+	signingKeysMutex.RLock()
+	key, ok := signingKeys[keyID]
+	signingKeysMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("signing key %q does not use %s", keyID, token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+// JWKS returns the public keys of all asymmetric signing keys. HS256 secrets are never published.
+func JWKS() models.JSONWebKeySet {
+	signingKeysMutex.RLock()
+	defer signingKeysMutex.RUnlock()
+	keySet := models.JSONWebKeySet{Keys: []models.JSONWebKey{}}
+	for _, key := range signingKeys {
+		webKey := models.JSONWebKey{KeyID: key.id, Algorithm: key.method.Alg(), Use: "sig"}
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			webKey.KeyType = "RSA"
+			webKey.Modulus = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			webKey.Exponent = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			webKey.KeyType = "OKP"
+			webKey.Curve = "Ed25519"
+			webKey.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+		keySet.Keys = append(keySet.Keys, webKey)
+	}
+	return keySet
+}
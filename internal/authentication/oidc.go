@@ -0,0 +1,325 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/pkg/config"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOIDCNotConfigured = errors.New("OIDC login is not configured")
+	ErrOIDCStateInvalid  = errors.New("unknown or expired OIDC login state")
+)
+
+// OIDCLoginTimeout is how long a user may take at the identity provider before the login state expires.
+const OIDCLoginTimeout = 10 * time.Minute
+
+// OIDCIdentity is the user the identity provider vouched for in an ID token.
+type OIDCIdentity struct {
+	Issuer            string
+	Subject           string
+	PreferredUsername string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pendingLogin is what the callback needs to finish a login that was started with OIDCAuthorizationURL.
+type pendingLogin struct {
+	nonce        string
+	codeVerifier string
+	expiresAt    time.Time
+}
+
+type oidcProvider struct {
+	config     config.OIDCConfig
+	httpClient *http.Client
+	mutex      sync.Mutex
+	// discovery and keys are fetched on first use, keys again whenever an unknown kid shows up
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	pending   map[string]pendingLogin
+}
+
+var oidc *oidcProvider
+
+// ConfigureOIDC enables login through the given identity provider, an empty issuer disables it.
+func ConfigureOIDC(oidcConfig config.OIDCConfig) {
+	if oidcConfig.Issuer == "" {
+		oidc = nil
+		return
+	}
+	provider := &oidcProvider{
+		config:     oidcConfig,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		pending:    make(map[string]pendingLogin),
+	}
+	if len(provider.config.Scopes) == 0 {
+		provider.config.Scopes = []string{"openid", "profile"}
+	}
+	oidc = provider
+}
+
+// OIDCAuthorizationURL starts a login and returns where to send the user together with the login's
+// state, which the caller has to tie to the user's browser. The state, nonce and PKCE verifier are
+// kept in memory, so a login has to finish on the server instance it started on.
+func OIDCAuthorizationURL() (string, string, error) {
+	if oidc == nil {
+		return "", "", ErrOIDCNotConfigured
+	}
+	discovery, err := oidc.discover()
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	codeVerifier, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	oidc.mutex.Lock()
+	for pendingState, login := range oidc.pending {
+		if now.After(login.expiresAt) {
+			delete(oidc.pending, pendingState)
+		}
+	}
+	oidc.pending[state] = pendingLogin{nonce: nonce, codeVerifier: codeVerifier, expiresAt: now.Add(OIDCLoginTimeout)}
+	oidc.mutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.config.ClientID},
+		"redirect_uri":          {oidc.config.RedirectURL},
+		"scope":                 {strings.Join(oidc.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// CompleteOIDCLogin exchanges the authorization code for an ID token and returns the verified identity.
+func CompleteOIDCLogin(code string, state string) (*OIDCIdentity, error) {
+	if oidc == nil {
+		return nil, ErrOIDCNotConfigured
+	}
+	oidc.mutex.Lock()
+	login, ok := oidc.pending[state]
+	delete(oidc.pending, state)
+	oidc.mutex.Unlock()
+	if !ok || time.Now().After(login.expiresAt) {
+		return nil, ErrOIDCStateInvalid
+	}
+
+	discovery, err := oidc.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidc.config.RedirectURL},
+		"code_verifier": {login.codeVerifier},
+	}
+	request, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(oidc.config.ClientID), url.QueryEscape(oidc.config.ClientSecret))
+	response, err := oidc.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint answered with status %d", response.StatusCode)
+	}
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	return oidc.verifyIDToken(discovery, tokenResponse.IDToken, login.nonce)
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+func (provider *oidcProvider) verifyIDToken(discovery *oidcDiscovery, rawToken string, nonce string) (*OIDCIdentity, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, provider.verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(provider.config.ClientID),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("invalid ID token: nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid ID token: missing subject")
+	}
+	return &OIDCIdentity{Issuer: discovery.Issuer, Subject: claims.Subject, PreferredUsername: claims.PreferredUsername}, nil
+}
+
+// verificationKey is the jwt.Keyfunc for ID tokens. An unknown kid reloads the provider's keys once,
+// which is how key rotation at the provider is picked up.
+func (provider *oidcProvider) verificationKey(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+	provider.mutex.Lock()
+	key, ok := provider.keys[keyID]
+	provider.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	if err := provider.loadKeys(); err != nil {
+		return nil, err
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if key, ok = provider.keys[keyID]; !ok {
+		return nil, fmt.Errorf("unknown ID token key %q", keyID)
+	}
+	return key, nil
+}
+
+func (provider *oidcProvider) discover() (*oidcDiscovery, error) {
+	provider.mutex.Lock()
+	discovery := provider.discovery
+	provider.mutex.Unlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	discovery = &oidcDiscovery{}
+	discoveryURL := strings.TrimSuffix(provider.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJSON(discoveryURL, discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	if discovery.Issuer != provider.config.Issuer {
+		return nil, fmt.Errorf("OIDC provider claims to be %q instead of %q", discovery.Issuer, provider.config.Issuer)
+	}
+	provider.mutex.Lock()
+	provider.discovery = discovery
+	provider.mutex.Unlock()
+	return discovery, nil
+}
+
+func (provider *oidcProvider) loadKeys() error {
+	discovery, err := provider.discover()
+	if err != nil {
+		return err
+	}
+	var keySet models.JSONWebKeySet
+	if err := provider.getJSON(discovery.JWKSURI, &keySet); err != nil {
+		return fmt.Errorf("failed to load OIDC provider keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, webKey := range keySet.Keys {
+		if key, err := publicKeyFromJWK(webKey); err == nil {
+			keys[webKey.KeyID] = key
+		}
+	}
+	provider.mutex.Lock()
+	provider.keys = keys
+	provider.mutex.Unlock()
+	return nil
+}
+
+func (provider *oidcProvider) getJSON(url string, target interface{}) error {
+	response, err := provider.httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered with status %d", url, response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+func publicKeyFromJWK(webKey models.JSONWebKey) (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch webKey.KeyType {
+	case "RSA":
+		modulus, err := decode(webKey.Modulus)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := decode(webKey.Exponent)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}, nil
+	case "EC":
+		if webKey.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", webKey.Curve)
+		}
+		x, err := decode(webKey.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(webKey.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(webKey.X)
+		if err != nil || webKey.Curve != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", webKey.KeyType)
+}
+
+func randomString() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
@@ -0,0 +1,51 @@
+package authentication
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrWeakPassword = errors.New("password must have between 10 and 72 characters")
+
+var (
+	maxLoginFailures = 5
+	loginLockout     = 15 * time.Minute
+)
+
+// dummyPasswordHash is compared against when a username is unknown, so that a failed login takes
+// as long for unknown users as for known ones.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// SetLoginLockout configures how many failed logins in a row lock an account and for how long.
+func SetLoginLockout(maxFailures int, lockout time.Duration) {
+	maxLoginFailures = maxFailures
+	loginLockout = lockout
+}
+
+func LoginLockout() (int, time.Duration) {
+	return maxLoginFailures, loginLockout
+}
+
+// HashPassword checks the password's length and returns its bcrypt hash. bcrypt ignores
+// everything after 72 bytes, so longer passwords are rejected instead of silently truncated.
+func HashPassword(password string) (string, error) {
+	if utf8.RuneCountInString(password) < 10 || len(password) > 72 {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether the password matches the hash. An empty hash never matches.
+func CheckPassword(hash string, password string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
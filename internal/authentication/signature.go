@@ -0,0 +1,55 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+)
+
+// signatureVersion is mixed into every signature so the canonical encoding can change later
+// without old signatures verifying under the new one.
+const signatureVersion = "chat.v2"
+
+// canonicalMessage encodes every field a client chooses. Each field is prefixed with its length,
+// so no two different messages share an encoding even if their texts contain separators.
+func canonicalMessage(message models.Message) []byte {
+	var builder strings.Builder
+	for _, field := range []string{
+		signatureVersion,
+		strconv.Itoa(message.ClientID),
+		message.ChatID,
+		strconv.Itoa(message.RecipientID),
+		message.Recipient,
+		strconv.FormatInt(message.Timestamp_ms, 10),
+		message.Nonce,
+		message.IdempotencyKey,
+		message.Text,
+	} {
+		builder.WriteString(strconv.Itoa(len(field)))
+		builder.WriteByte(':')
+		builder.WriteString(field)
+	}
+	return []byte(builder.String())
+}
+
+// SignMessage returns the hex encoded HMAC-SHA256 of the message keyed with the client's salt.
+func SignMessage(message models.Message, salt string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write(canonicalMessage(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyMessage checks the message's Hash in constant time.
+func VerifyMessage(message models.Message, salt string) bool {
+	signature, err := hex.DecodeString(message.Hash)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write(canonicalMessage(message))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
@@ -0,0 +1,72 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+var accessTokenTTL = 15 * time.Minute
+var refreshTokenTTL = 30 * 24 * time.Hour
+
+// revokedTokens maps the IDs of revoked access tokens to the time they would have expired anyway.
+var revokedTokens = make(map[string]time.Time)
+var revokedTokensMutex sync.RWMutex
+
+func SetTokenLifetimes(accessTTL time.Duration, refreshTTL time.Duration) {
+	accessTokenTTL = accessTTL
+	refreshTokenTTL = refreshTTL
+}
+
+func AccessTokenTTL() time.Duration {
+	return accessTokenTTL
+}
+
+// GenerateRefreshToken returns a random opaque refresh token, the hash it is stored under and its expiry.
+func GenerateRefreshToken() (string, string, time.Time, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(randomBytes)
+	return token, HashRefreshToken(token), time.Now().Add(refreshTokenTTL), nil
+}
+
+// HashRefreshToken derives the value refresh tokens are stored under, so that a database leak
+// does not hand out usable tokens.
+func HashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// RevokeToken puts an access token on the revocation list until it expires.
+func RevokeToken(tokenID string, expiresAt time.Time) {
+	revokedTokensMutex.Lock()
+	defer revokedTokensMutex.Unlock()
+	revokedTokens[tokenID] = expiresAt
+}
+
+func IsTokenRevoked(tokenID string) bool {
+	revokedTokensMutex.RLock()
+	defer revokedTokensMutex.RUnlock()
+	_, revoked := revokedTokens[tokenID]
+	return revoked
+}
+
+// LoadRevokedTokens replaces the revocation list, dropping entries that have expired.
+func LoadRevokedTokens(tokens map[string]time.Time) {
+	revokedTokensMutex.Lock()
+	defer revokedTokensMutex.Unlock()
+	revokedTokens = make(map[string]time.Time, len(tokens))
+	for tokenID, expiresAt := range tokens {
+		if expiresAt.After(time.Now()) {
+			revokedTokens[tokenID] = expiresAt
+		}
+	}
+}
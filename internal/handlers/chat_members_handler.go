@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/permissions"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"log"
+	"net/http"
+)
+
+// loadGroupChat looks up the chat named in the request path and makes sure it is a group chat.
+// It writes the error response and returns nil otherwise.
+func loadGroupChat(database storage.Store, writer http.ResponseWriter, request *http.Request) *models.Chat {
+	chat, err := database.GetChat(request.PathValue("chatId"))
+	if errors.Is(err, storage.ErrChatNotFound) {
+		http.Error(writer, "Chat not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Loading chat %s failed: %v", request.PathValue("chatId"), err)
+		http.Error(writer, "Error loading chat", http.StatusInternalServerError)
+		return nil
+	}
+	if chat.Kind != models.ChatKindGroup {
+		http.Error(writer, "Chat is not a group chat", http.StatusBadRequest)
+		return nil
+	}
+	return chat
+}
+
+// refreshChatIndex reloads the members of a chat into the index after its membership changed.
+func refreshChatIndex(database storage.Store, chats *models.ChatIndex, chatID string) {
+	members, err := database.GetChatMembers(chatID)
+	if err != nil {
+		log.Printf("Reloading members of chat %s failed: %v", chatID, err)
+		return
+	}
+	chats.SetMembers(chatID, members)
+}
+
+func isChatMember(database storage.Store, chatID string, clientID int) (bool, error) {
+	members, err := database.GetChatMembers(chatID)
+	if err != nil {
+		return false, err
+	}
+	for _, memberID := range members {
+		if memberID == clientID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func InviteToChat(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		ClientID int    `json:"clientId"`
+		Username string `json:"username"`
+	}
+
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chat := loadGroupChat(database, writer, request)
+	if chat == nil {
+		return
+	}
+	if _, ok := authorize(database, writer, clientID, chat.ChatID, permissions.InviteMember); !ok {
+		return
+	}
+
+	inviteeID := submittedRequest.ClientID
+	if submittedRequest.Username != "" {
+		inviteeID, err = database.GetClientIDByUsername(submittedRequest.Username)
+		if err != nil {
+			http.Error(writer, "Unknown client", http.StatusNotFound)
+			return
+		}
+	} else if exists, err := database.ClientExists(inviteeID); err != nil || !exists {
+		http.Error(writer, "Unknown client", http.StatusNotFound)
+		return
+	}
+
+	if err := database.InviteToChat(chat.ChatID, inviteeID, clientID); err != nil {
+		log.Printf("Inviting client %d to chat %s failed: %v", inviteeID, chat.ChatID, err)
+		http.Error(writer, "Error storing invitation", http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	log.Printf("Client %d invited client %d to chat %s", clientID, inviteeID, chat.ChatID)
+}
+
+func JoinChat(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	chat := loadGroupChat(database, writer, request)
+	if chat == nil {
+		return
+	}
+	err := database.AcceptInvitation(chat.ChatID, clientID)
+	if errors.Is(err, storage.ErrNotInvited) {
+		http.Error(writer, "No pending invitation", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Client %d joining chat %s failed: %v", clientID, chat.ChatID, err)
+		http.Error(writer, "Error joining chat", http.StatusInternalServerError)
+		return
+	}
+	refreshChatIndex(database, chats, chat.ChatID)
+	writer.WriteHeader(http.StatusNoContent)
+	log.Printf("Client %d joined chat %s", clientID, chat.ChatID)
+}
+
+func LeaveChat(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	chat := loadGroupChat(database, writer, request)
+	if chat == nil {
+		return
+	}
+	if err := database.RemoveChatMember(chat.ChatID, clientID); err != nil {
+		log.Printf("Client %d leaving chat %s failed: %v", clientID, chat.ChatID, err)
+		http.Error(writer, "Error leaving chat", http.StatusInternalServerError)
+		return
+	}
+	refreshChatIndex(database, chats, chat.ChatID)
+	writer.WriteHeader(http.StatusNoContent)
+	log.Printf("Client %d left chat %s", clientID, chat.ChatID)
+}
+
+func ListChatMembers(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	chat := loadGroupChat(database, writer, request)
+	if chat == nil {
+		return
+	}
+	members, err := database.GetChatMemberDetails(chat.ChatID)
+	if err != nil {
+		log.Printf("Loading members of chat %s failed: %v", chat.ChatID, err)
+		http.Error(writer, "Error loading chat members", http.StatusInternalServerError)
+		return
+	}
+	isMember := false
+	for _, member := range members {
+		isMember = isMember || member.ClientID == clientID
+	}
+	if !isMember {
+		http.Error(writer, "Only members can list a chat", http.StatusForbidden)
+		return
+	}
+
+	response := struct {
+		Chat    *models.Chat        `json:"chat"`
+		Members []models.ChatMember `json:"members"`
+	}{Chat: chat, Members: members}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(response)
+}
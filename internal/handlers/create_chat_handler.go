@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"log"
+	"net/http"
+)
+
+// CreateChat creates a group chat owned by the client. The listed members are invited, nobody
+// becomes a member without joining.
+func CreateChat(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		ChatID  string `json:"chatId"`
+		Name    string `json:"name"`
+		Members []int  `json:"members"`
+	}
+
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if submittedRequest.ChatID == "" {
+		http.Error(writer, "Missing chat ID", http.StatusBadRequest)
+		return
+	}
+	// Direct messages are routed by these IDs, a group chat using one would intercept them
+	if models.IsReservedChatID(submittedRequest.ChatID) {
+		http.Error(writer, "Chat ID is reserved", http.StatusBadRequest)
+		return
+	}
+
+	for _, memberID := range submittedRequest.Members {
+		if exists, err := database.ClientExists(memberID); err != nil || !exists {
+			http.Error(writer, fmt.Sprintf("Unknown client %d", memberID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = database.CreateChat(clientID, submittedRequest.ChatID, submittedRequest.Name, nil)
+	if errors.Is(err, storage.ErrChatExists) {
+		http.Error(writer, "Chat already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Creating chat %s failed: %v", submittedRequest.ChatID, err)
+		http.Error(writer, "Error creating chat", http.StatusInternalServerError)
+		return
+	}
+
+	for _, memberID := range submittedRequest.Members {
+		if memberID == clientID {
+			continue
+		}
+		if err := database.InviteToChat(submittedRequest.ChatID, memberID, clientID); err != nil {
+			log.Printf("Inviting client %d to chat %s failed: %v", memberID, submittedRequest.ChatID, err)
+			http.Error(writer, "Error storing invitation", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	members, err := database.GetChatMembers(submittedRequest.ChatID)
+	if err != nil {
+		log.Printf("Loading members of chat %s failed: %v", submittedRequest.ChatID, err)
+		http.Error(writer, "Error creating chat", http.StatusInternalServerError)
+		return
+	}
+	chats.SetMembers(submittedRequest.ChatID, members)
+
+	response := struct {
+		ChatID  string `json:"chatId"`
+		Name    string `json:"name"`
+		Members []int  `json:"members"`
+		Invited []int  `json:"invited"`
+	}{ChatID: submittedRequest.ChatID, Name: submittedRequest.Name, Members: members, Invited: submittedRequest.Members}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(response)
+	log.Printf("Client %d created chat %s", clientID, submittedRequest.ChatID)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/permissions"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func CreateInvite(database storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint, an empty body creates a single-use invite that never expires
+	var submittedRequest struct {
+		MaxUses int `json:"maxUses"`
+		// ExpiresIn is the invite's lifetime in seconds
+		ExpiresIn int64 `json:"expiresIn"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if submittedRequest.MaxUses == 0 {
+		submittedRequest.MaxUses = 1
+	}
+	if submittedRequest.MaxUses < 0 || submittedRequest.ExpiresIn < 0 {
+		http.Error(writer, "maxUses and expiresIn must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt time.Time
+	if submittedRequest.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(submittedRequest.ExpiresIn) * time.Second)
+	}
+	code, err := authentication.GenerateInviteCode()
+	if err != nil {
+		http.Error(writer, "Error generating invite", http.StatusInternalServerError)
+		return
+	}
+	invite, err := database.CreateInvite(code, clientID, submittedRequest.MaxUses, expiresAt)
+	if err != nil {
+		log.Printf("Creating invite failed: %v", err)
+		http.Error(writer, "Error creating invite", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(database, clientID, permissions.ManageInvites, "", "create:"+strconv.Itoa(invite.ID))
+	log.Printf("Admin %d created invite %d for %d uses", clientID, invite.ID, invite.MaxUses)
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(invite)
+}
+
+func ListInvites(database storage.Store, _ *models.ChatIndex, _ int, writer http.ResponseWriter, request *http.Request) {
+	invites, err := database.ListInvites()
+	if err != nil {
+		log.Printf("Listing invites failed: %v", err)
+		http.Error(writer, "Error listing invites", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(invites)
+}
+
+func RevokeInvite(database storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	inviteID, err := strconv.Atoi(request.PathValue("inviteId"))
+	if err != nil {
+		http.Error(writer, "Invalid invite id", http.StatusBadRequest)
+		return
+	}
+	err = database.RevokeInvite(inviteID)
+	if errors.Is(err, storage.ErrInviteNotFound) {
+		http.Error(writer, "Invite not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Revoking invite %d failed: %v", inviteID, err)
+		http.Error(writer, "Error revoking invite", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(database, clientID, permissions.ManageInvites, "", "revoke:"+strconv.Itoa(inviteID))
+	log.Printf("Admin %d revoked invite %d", clientID, inviteID)
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"net/http"
+)
+
+// JSONWebKeySet publishes the public signing keys so other services can verify our tokens.
+func JSONWebKeySet(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(writer).Encode(authentication.JWKS())
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Login lets a returning client get new tokens with its username and password, e.g. on a new device.
+func Login(database storage.Store, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Unknown usernames and locked accounts fail like wrong passwords and take as long, so that
+	// the response does not tell which usernames exist
+	state, err := database.GetLoginState(submittedRequest.Username)
+	if errors.Is(err, storage.ErrClientNotFound) {
+		authentication.CheckPassword("", submittedRequest.Password)
+		http.Error(writer, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Loading login state of %s failed: %v", submittedRequest.Username, err)
+		http.Error(writer, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	// The attempt counts as failed until the password turns out right
+	maxFailures, lockout := authentication.LoginLockout()
+	lockedUntil, err := database.RecordLoginAttempt(state.ClientID, maxFailures, lockout)
+	if errors.Is(err, storage.ErrAccountLocked) {
+		authentication.CheckPassword("", submittedRequest.Password)
+		http.Error(writer, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Recording login attempt of client %d failed: %v", state.ClientID, err)
+		http.Error(writer, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	if !authentication.CheckPassword(state.PasswordHash, submittedRequest.Password) {
+		if !lockedUntil.IsZero() {
+			log.Printf("Client %d is locked until %s after %d failed logins", state.ClientID, lockedUntil.Format(time.RFC3339), maxFailures)
+		}
+		http.Error(writer, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err := database.ResetLoginFailures(state.ClientID); err != nil {
+		log.Printf("Resetting failed logins of client %d failed: %v", state.ClientID, err)
+	}
+
+	tokens, err := issueTokens(database, state.ClientID, submittedRequest.Username)
+	if err != nil {
+		log.Printf("Issuing tokens for client %d failed: %v", state.ClientID, err)
+		http.Error(writer, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	client := models.Client{
+		ID:           state.ClientID,
+		Username:     submittedRequest.Username,
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		Salt:         state.Salt,
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(client)
+	log.Printf("Client %d logged in", state.ClientID)
+}
+
+// ChangePassword sets a new password. Clients that already have one have to confirm the current
+// password, clients registered without one can set their first password with their token.
+func ChangePassword(database storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	currentHash, err := database.GetPasswordHash(clientID)
+	if err != nil {
+		log.Printf("Loading password of client %d failed: %v", clientID, err)
+		http.Error(writer, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+	if currentHash != "" && !authentication.CheckPassword(currentHash, submittedRequest.CurrentPassword) {
+		http.Error(writer, "Current password is wrong", http.StatusForbidden)
+		return
+	}
+	newHash, err := authentication.HashPassword(submittedRequest.NewPassword)
+	if errors.Is(err, authentication.ErrWeakPassword) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+	if err := database.SetPassword(clientID, newHash); err != nil {
+		log.Printf("Setting password of client %d failed: %v", clientID, err)
+		http.Error(writer, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Client %d changed its password", clientID)
+	writer.WriteHeader(http.StatusNoContent)
+}
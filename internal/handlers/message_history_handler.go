@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// parseHistoryQuery reads the cursor and page size from the query string.
+func parseHistoryQuery(chatID string, values url.Values) (models.HistoryQuery, error) {
+	query := models.HistoryQuery{ChatID: chatID}
+	integers := map[string]*int{"before": &query.Before, "after": &query.After, "beforeSeq": &query.BeforeSeq,
+		"afterSeq": &query.AfterSeq, "limit": &query.Limit}
+	for name, target := range integers {
+		if value := values.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return query, fmt.Errorf("invalid %s", name)
+			}
+			*target = parsed
+		}
+	}
+	timestamps := map[string]*int64{"beforeMs": &query.BeforeMs, "afterMs": &query.AfterMs}
+	for name, target := range timestamps {
+		if value := values.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || parsed < 0 {
+				return query, fmt.Errorf("invalid %s", name)
+			}
+			*target = parsed
+		}
+	}
+	return query, nil
+}
+
+func GetMessageHistory(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	query, err := parseHistoryQuery(request.PathValue("chatId"), request.URL.Query())
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	isMember, err := isChatMember(database, query.ChatID, clientID)
+	if err != nil {
+		log.Printf("Loading members of chat %s failed: %v", query.ChatID, err)
+		http.Error(writer, "Error loading chat", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(writer, "Only members can read a chat", http.StatusForbidden)
+		return
+	}
+
+	page, err := database.RetrieveMessageHistory(query)
+	if err != nil {
+		log.Printf("Loading history of chat %s failed: %v", query.ChatID, err)
+		http.Error(writer, "Error loading messages", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(page)
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/permissions"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// authorize checks a chat action for the client and returns its roles. It writes the error
+// response and returns false if the action is not allowed.
+func authorize(database storage.Store, writer http.ResponseWriter, clientID int, chatID string, action permissions.Action) (models.Roles, bool) {
+	roles, err := permissions.Authorize(database, clientID, chatID, action)
+	if errors.Is(err, permissions.ErrForbidden) {
+		http.Error(writer, "Permission denied", http.StatusForbidden)
+		return roles, false
+	}
+	if err != nil {
+		log.Printf("Checking permissions of client %d failed: %v", clientID, err)
+		http.Error(writer, "Error checking permissions", http.StatusInternalServerError)
+		return roles, false
+	}
+	return roles, true
+}
+
+// recordAudit logs instead of failing the request, the action itself already happened.
+func recordAudit(database storage.Store, actorID int, action permissions.Action, chatID string, target string) {
+	if err := database.RecordAudit(actorID, string(action), chatID, target); err != nil {
+		log.Printf("Recording %s by client %d failed: %v", action, actorID, err)
+	}
+}
+
+// chatMemberRole returns the chat role of a member, or an empty string for non-members.
+func chatMemberRole(database storage.Store, chatID string, clientID int) (string, error) {
+	roles, err := database.GetRoles(clientID, chatID)
+	if err != nil {
+		return "", err
+	}
+	return roles.Chat, nil
+}
+
+func KickMember(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		ClientID int `json:"clientId"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chat := loadGroupChat(database, writer, request)
+	if chat == nil {
+		return
+	}
+	roles, ok := authorize(database, writer, clientID, chat.ChatID, permissions.KickMember)
+	if !ok {
+		return
+	}
+	targetRole, err := chatMemberRole(database, chat.ChatID, submittedRequest.ClientID)
+	if errors.Is(err, storage.ErrClientNotFound) || (err == nil && targetRole == "") {
+		http.Error(writer, "Client is not a member of the chat", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Loading role of client %d in chat %s failed: %v", submittedRequest.ClientID, chat.ChatID, err)
+		http.Error(writer, "Error loading chat members", http.StatusInternalServerError)
+		return
+	}
+	if !permissions.Outranks(roles, targetRole) {
+		http.Error(writer, "Cannot kick a member of equal or higher rank", http.StatusForbidden)
+		return
+	}
+
+	if err := database.RemoveChatMember(chat.ChatID, submittedRequest.ClientID); err != nil {
+		log.Printf("Kicking client %d from chat %s failed: %v", submittedRequest.ClientID, chat.ChatID, err)
+		http.Error(writer, "Error removing chat member", http.StatusInternalServerError)
+		return
+	}
+	refreshChatIndex(database, chats, chat.ChatID)
+	recordAudit(database, clientID, permissions.KickMember, chat.ChatID, strconv.Itoa(submittedRequest.ClientID))
+	writer.WriteHeader(http.StatusNoContent)
+	log.Printf("Client %d kicked client %d from chat %s", clientID, submittedRequest.ClientID, chat.ChatID)
+}
+
+func SetChatRole(database storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		Role string `json:"role"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !models.IsChatRole(submittedRequest.Role) {
+		http.Error(writer, "Unknown chat role", http.StatusBadRequest)
+		return
+	}
+	memberID, err := strconv.Atoi(request.PathValue("clientId"))
+	if err != nil {
+		http.Error(writer, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+
+	chat := loadGroupChat(database, writer, request)
+	if chat == nil {
+		return
+	}
+	if _, ok := authorize(database, writer, clientID, chat.ChatID, permissions.SetChatRole); !ok {
+		return
+	}
+	err = database.SetChatRole(chat.ChatID, memberID, submittedRequest.Role)
+	if errors.Is(err, storage.ErrNotChatMember) {
+		http.Error(writer, "Client is not a member of the chat", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Setting role of client %d in chat %s failed: %v", memberID, chat.ChatID, err)
+		http.Error(writer, "Error setting chat role", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(database, clientID, permissions.SetChatRole, chat.ChatID, fmt.Sprintf("%d:%s", memberID, submittedRequest.Role))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func DeleteMessage(database storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	messageID, err := strconv.Atoi(request.PathValue("messageId"))
+	if err != nil {
+		http.Error(writer, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+	chatID, err := permissions.AuthorizeMessageDeletion(database, clientID, messageID)
+	if errors.Is(err, storage.ErrMessageNotFound) || (err == nil && chatID != request.PathValue("chatId")) {
+		http.Error(writer, "Message not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, permissions.ErrForbidden) {
+		http.Error(writer, "Permission denied", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Checking deletion of message %d by client %d failed: %v", messageID, clientID, err)
+		http.Error(writer, "Error deleting message", http.StatusInternalServerError)
+		return
+	}
+	err = database.DeleteMessage(messageID)
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		http.Error(writer, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Deleting message %d failed: %v", messageID, err)
+		http.Error(writer, "Error deleting message", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(database, clientID, permissions.DeleteMessage, chatID, strconv.Itoa(messageID))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func SetServerRole(database storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		Role string `json:"role"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !models.IsServerRole(submittedRequest.Role) {
+		http.Error(writer, "Unknown server role", http.StatusBadRequest)
+		return
+	}
+	targetID, err := strconv.Atoi(request.PathValue("clientId"))
+	if err != nil {
+		http.Error(writer, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	err = database.SetServerRole(targetID, submittedRequest.Role)
+	if errors.Is(err, storage.ErrClientNotFound) {
+		http.Error(writer, "Unknown client", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Setting server role of client %d failed: %v", targetID, err)
+		http.Error(writer, "Error setting server role", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(database, clientID, permissions.SetServerRole, "", fmt.Sprintf("%d:%s", targetID, submittedRequest.Role))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func ListAuditLog(database storage.Store, _ *models.ChatIndex, _ int, writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	limit := models.DefaultHistoryLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(writer, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, models.MaxHistoryLimit)
+	}
+	before := 0
+	if value := query.Get("before"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(writer, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+
+	entries, err := database.ListAuditLog(before, limit)
+	if err != nil {
+		log.Printf("Listing audit log failed: %v", err)
+		http.Error(writer, "Error listing audit log", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(entries)
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// oidcStateCookie holds the state of the login the browser started, so a callback carrying another
+// browser's state is refused instead of logging the user in as someone else.
+const oidcStateCookie = "oidc_state"
+
+// setOIDCStateCookie stores the login state in the browser, an empty state with a negative age removes it.
+func setOIDCStateCookie(writer http.ResponseWriter, request *http.Request, state string, maxAge int) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCLogin redirects the user to the identity provider.
+func OIDCLogin(writer http.ResponseWriter, request *http.Request) {
+	authorizationURL, state, err := authentication.OIDCAuthorizationURL()
+	if errors.Is(err, authentication.ErrOIDCNotConfigured) {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Starting OIDC login failed: %v", err)
+		http.Error(writer, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	setOIDCStateCookie(writer, request, state, int(authentication.OIDCLoginTimeout.Seconds()))
+	http.Redirect(writer, request, authorizationURL, http.StatusFound)
+}
+
+// OIDCCallback finishes the login the identity provider redirected back from. Users logging in
+// for the first time get a client without needing an invite.
+func OIDCCallback(database storage.Store, writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		http.Error(writer, "Login failed at the identity provider: "+providerError, http.StatusUnauthorized)
+		return
+	}
+	state := query.Get("state")
+	cookie, err := request.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(writer, "Login was not started in this browser", http.StatusUnauthorized)
+		return
+	}
+	setOIDCStateCookie(writer, request, "", -1)
+	identity, err := authentication.CompleteOIDCLogin(query.Get("code"), state)
+	if errors.Is(err, authentication.ErrOIDCNotConfigured) {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Completing OIDC login failed: %v", err)
+		http.Error(writer, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	client, err := database.ProvisionIdentityClient(identity.Issuer, identity.Subject, oidcUsername(identity), uuid.New().String())
+	if err != nil {
+		log.Printf("Provisioning client for %s at %s failed: %v", identity.Subject, identity.Issuer, err)
+		http.Error(writer, "Error adding client to database", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := issueTokens(database, client.ID, client.Username)
+	if err != nil {
+		log.Printf("Issuing tokens for client %d failed: %v", client.ID, err)
+		http.Error(writer, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	client.Token = tokens.Token
+	client.RefreshToken = tokens.RefreshToken
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(client)
+	log.Printf("Client %d logged in through %s", client.ID, identity.Issuer)
+}
+
+// oidcUsername turns the identity provider's preferred username into one that passes the rules
+// for registered usernames: alphanumeric and at least six characters long.
+func oidcUsername(identity *authentication.OIDCIdentity) string {
+	username := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, identity.PreferredUsername)
+	if username == "" {
+		username = "user"
+	}
+	for len(username) < 6 {
+		username += "0"
+	}
+	return username
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/Schwarf/prototype_chat_server/internal/authentication"
 	"github.com/Schwarf/prototype_chat_server/internal/models"
 	"github.com/Schwarf/prototype_chat_server/internal/storage"
@@ -11,19 +12,21 @@ import (
 )
 
 type RegisterHandler struct {
-	database    *storage.DB
-	HandlerFunc func(db *storage.DB, w http.ResponseWriter, r *http.Request)
+	database    storage.Store
+	HandlerFunc func(db storage.Store, w http.ResponseWriter, r *http.Request)
 }
 
 func (handler RegisterHandler) RegisterClient(w http.ResponseWriter, r *http.Request) {
 	handler.HandlerFunc(handler.database, w, r)
 }
 
-func RegisterClient(database *storage.DB, writer http.ResponseWriter, request *http.Request) {
+func RegisterClient(database storage.Store, writer http.ResponseWriter, request *http.Request) {
 	// Expected request send to endpoint
 	var submittedRequest struct {
 		Secret   string `json:"secret"`
 		Username string `json:"username"`
+		// Password is optional, without it the client can only come back through its refresh token
+		Password string `json:"password"`
 	}
 
 	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
@@ -33,48 +36,54 @@ func RegisterClient(database *storage.DB, writer http.ResponseWriter, request *h
 		return
 	}
 
-	// Validate the submitted secret
-	if !authentication.IsSecretValid(submittedRequest.Secret) {
-		log.Println("Invalid secret. Registration declined!")
-		http.Error(writer, "Invalid secret", http.StatusUnauthorized)
+	if len(submittedRequest.Username) < 6 || !authentication.IsAlphaNumeric(submittedRequest.Username) {
+		http.Error(writer, "Invalid username", http.StatusUnauthorized)
 		return
 	}
 
-	err = storage.MarkSecretAsUsed(database, submittedRequest.Secret)
-	if err != nil {
-		log.Println("Invalid secret. Already known in persistence.")
-		return
+	var passwordHash string
+	if submittedRequest.Password != "" {
+		passwordHash, err = authentication.HashPassword(submittedRequest.Password)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	if len(submittedRequest.Username) < 6 || !authentication.IsAlphaNumeric(submittedRequest.Username) {
-		http.Error(writer, "Invalid username", http.StatusUnauthorized)
+	// The invite is consumed together with adding the client, a failed registration keeps it valid.
+	// Nobody registers as an admin, admins are promoted with the promote-admin command.
+	salt := uuid.New().String()
+	clientID, err := database.RegisterClientWithInvite(submittedRequest.Secret, submittedRequest.Username, salt, passwordHash, models.RoleMember)
+	if errors.Is(err, storage.ErrInviteInvalid) {
+		log.Println("Invalid secret. Registration declined!")
+		http.Error(writer, "Invalid secret", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, storage.ErrUsernameTaken) {
+		http.Error(writer, "Username already taken", http.StatusConflict)
 		return
 	}
-
-	token, err := authentication.GenerateToken(submittedRequest.Username)
 	if err != nil {
-		http.Error(writer, "Error generating token", http.StatusInternalServerError)
+		log.Printf("Registering client %s failed: %v", submittedRequest.Username, err)
+		http.Error(writer, "Error adding client to database", http.StatusInternalServerError)
 		return
 	}
 
-	salt := uuid.New().String()
-	clientID, err := storage.AddClient(database, submittedRequest.Username, token, salt)
-
+	tokens, err := issueTokens(database, clientID, submittedRequest.Username)
 	if err != nil {
-		http.Error(writer, "Error adding client to database", http.StatusInternalServerError)
+		log.Printf("Issuing tokens for client %d failed: %v", clientID, err)
+		http.Error(writer, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
 	client := models.Client{
-		ID:       clientID,
-		Username: submittedRequest.Username,
-		Token:    token,
-		Salt:     salt,
+		ID:           clientID,
+		Username:     submittedRequest.Username,
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		Salt:         salt,
 	}
 
-	authentication.RemoveSecret(submittedRequest.Secret)
-	authentication.RegisterClient(clientID, client)
-
 	writer.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(writer).Encode(client)
 	log.Println("Client has been registered successfully")
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"log"
+	"net/http"
+	"sync"
+)
+
+func ListSessions(clients map[*models.ChatClient]bool, clientsMutex *sync.Mutex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	clientsMutex.Lock()
+	sessions := []models.Session{}
+	for client := range clients {
+		if client.ID == clientID && client.Online {
+			sessions = append(sessions, client.Session())
+		}
+	}
+	clientsMutex.Unlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(sessions)
+}
+
+func TerminateSession(clients map[*models.ChatClient]bool, clientsMutex *sync.Mutex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	sessionID := request.PathValue("sessionId")
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	for client := range clients {
+		if client.ID == clientID && client.SessionID == sessionID {
+			// The writer goroutine sends a close frame and closes the connection
+			client.Close()
+			client.Online = false
+			writer.WriteHeader(http.StatusNoContent)
+			log.Printf("Client %d terminated session %s", clientID, sessionID)
+			return
+		}
+	}
+	http.Error(writer, "Session not found", http.StatusNotFound)
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// issueTokens creates an access token and a new refresh token for the client.
+func issueTokens(database storage.Store, clientID int, username string) (*models.Tokens, error) {
+	token, err := authentication.GenerateToken(clientID, username)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshTokenHash, expiresAt, err := authentication.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := database.StoreRefreshToken(clientID, refreshTokenHash, expiresAt); err != nil {
+		return nil, err
+	}
+	return &models.Tokens{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(authentication.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+func RefreshToken(database storage.Store, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	refreshToken, refreshTokenHash, expiresAt, err := authentication.GenerateRefreshToken()
+	if err != nil {
+		http.Error(writer, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	clientID, err := database.RotateRefreshToken(authentication.HashRefreshToken(submittedRequest.RefreshToken), refreshTokenHash, expiresAt)
+	if errors.Is(err, storage.ErrRefreshTokenReused) {
+		log.Printf("Refresh token of client %d was reused, revoked all its refresh tokens", clientID)
+		http.Error(writer, "Refresh token reused", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, storage.ErrRefreshTokenInvalid) {
+		http.Error(writer, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Rotating refresh token failed: %v", err)
+		http.Error(writer, "Error refreshing token", http.StatusInternalServerError)
+		return
+	}
+
+	username, err := database.GetClientUsername(clientID)
+	if err != nil {
+		log.Printf("Loading client %d failed: %v", clientID, err)
+		http.Error(writer, "Error refreshing token", http.StatusInternalServerError)
+		return
+	}
+	token, err := authentication.GenerateToken(clientID, username)
+	if err != nil {
+		http.Error(writer, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(models.Tokens{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(authentication.AccessTokenTTL().Seconds()),
+	})
+}
+
+// RevokeToken revokes the access or refresh token in the request body, or the bearer token of the
+// request itself if the body names none. Sessions opened with a revoked access token are closed.
+func RevokeToken(database storage.Store, clients map[*models.ChatClient]bool, clientsMutex *sync.Mutex, clientID int, writer http.ResponseWriter, request *http.Request) {
+	// Expected request send to endpoint
+	var submittedRequest struct {
+		Token string `json:"token"`
+	}
+
+	err := json.NewDecoder(request.Body).Decode(&submittedRequest)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := authentication.ClaimsFromContext(request.Context())
+	if submittedRequest.Token != "" {
+		claims, err = authentication.ParseToken(submittedRequest.Token)
+		if errors.Is(err, authentication.ErrTokenExpired) || errors.Is(err, authentication.ErrTokenRevoked) {
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			// Not an access token, so it can only be one of the client's refresh tokens
+			found, err := database.RevokeRefreshToken(clientID, authentication.HashRefreshToken(submittedRequest.Token))
+			if err != nil {
+				log.Printf("Revoking refresh token of client %d failed: %v", clientID, err)
+				http.Error(writer, "Error revoking token", http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(writer, "Unknown token", http.StatusNotFound)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if owner, err := claims.ClientID(); err != nil || owner != clientID {
+		http.Error(writer, "Only the owner can revoke a token", http.StatusForbidden)
+		return
+	}
+	expiresAt := time.Now().Add(authentication.AccessTokenTTL())
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	if err := database.RevokeAccessToken(clientID, claims.ID, expiresAt); err != nil {
+		log.Printf("Revoking access token of client %d failed: %v", clientID, err)
+		http.Error(writer, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+	authentication.RevokeToken(claims.ID, expiresAt)
+
+	clientsMutex.Lock()
+	for client := range clients {
+		if client.TokenID == claims.ID {
+			client.Close()
+			client.Online = false
+			log.Printf("Closed session %s of client %d after its token was revoked", client.SessionID, clientID)
+		}
+	}
+	clientsMutex.Unlock()
+
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,19 @@
+package models
+
+// Acknowledgment confirms to a sender that its message was stored under MessageID.
+type Acknowledgment struct {
+	MessageID    int    `json:"messageId"`
+	ChatID       string `json:"chatId"`
+	Timestamp_ms int64  `json:"timestamp_ms"`
+	Seq          int    `json:"seq,omitempty"`
+}
+
+// DeliveryAck is sent by a recipient once it has received a message.
+type DeliveryAck struct {
+	MessageID int `json:"messageId"`
+}
+
+// DeleteRequest asks the server to delete a message, see the delete frame.
+type DeleteRequest struct {
+	MessageID int `json:"messageId"`
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	ChatKindGroup  = "group"
+	ChatKindDirect = "direct"
+	ChatKindSelf   = "self"
+)
+
+// The server names direct and self chats with these prefixes, so clients cannot create chats with them.
+const (
+	DirectChatPrefix = "dm-"
+	SelfChatPrefix   = "self-"
+)
+
+// IsReservedChatID reports whether the chat ID belongs to the keyspace of direct and self chats.
+func IsReservedChatID(chatID string) bool {
+	return strings.HasPrefix(chatID, DirectChatPrefix) || strings.HasPrefix(chatID, SelfChatPrefix)
+}
+
+type Chat struct {
+	ChatID    string `json:"chatId"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	CreatedBy int    `json:"createdBy"`
+}
+
+type ChatMember struct {
+	ClientID int    `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// ChatIndex caches the members of each chat so that messages can be routed
+// without hitting the database for every frame.
+type ChatIndex struct {
+	mutex   sync.RWMutex
+	members map[string]map[int]bool
+}
+
+func NewChatIndex() *ChatIndex {
+	return &ChatIndex{members: make(map[string]map[int]bool)}
+}
+
+// Members returns the cached member set of a chat and whether the chat is cached at all.
+func (index *ChatIndex) Members(chatID string) (map[int]bool, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	members, ok := index.members[chatID]
+	return members, ok
+}
+
+func (index *ChatIndex) SetMembers(chatID string, clientIDs []int) {
+	members := make(map[int]bool, len(clientIDs))
+	for _, clientID := range clientIDs {
+		members[clientID] = true
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.members[chatID] = members
+}
+
+func (index *ChatIndex) IsMember(chatID string, clientID int) bool {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	return index.members[chatID][clientID]
+}
@@ -1,22 +1,160 @@
 package models
 
 import (
+	"errors"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
 )
 
+var (
+	ErrSendQueueFull = errors.New("send queue is full")
+	ErrClientClosed  = errors.New("client is closed")
+)
+
+type outboundFrame struct {
+	messageType int
+	data        []byte
+}
+
 type ChatClient struct {
-	ID         int
-	Connection *websocket.Conn
-	Online     bool
+	ID        int
+	SessionID string
+	DeviceID  string
+	// TokenID is the ID of the access token the session authenticated with
+	TokenID     string
+	ConnectedAt time.Time
+	Connection  *websocket.Conn
+	Online      bool
+	Salt        string
+	// Sent holds the IDs of messages sent to the session, by the replay on connect or by the outbox,
+	// whose outbox entries may still be fanned out. IDs do not commit in order, so every message is
+	// looked up rather than compared with the highest ID sent. The server's mutex guards it.
+	Sent map[int]bool
+
+	// send queues frames for WritePump so that callers never block on the network.
+	send       chan outboundFrame
+	dropOldest bool
+	sendMutex  sync.Mutex
+	closed     bool
+}
+
+// Session describes one live connection of a client.
+type Session struct {
+	SessionID   string    `json:"sessionId"`
+	DeviceID    string    `json:"deviceId"`
+	ConnectedAt time.Time `json:"connectedAt"`
 }
 
 type Client struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Token    string `json:"token"`
-	Salt     string `json:"salt"`
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	Salt         string `json:"salt"`
 }
 
+// Tokens is handed out whenever a client signs in or refreshes its access token.
+type Tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+// NewChatClient creates a client with a send queue of bufferSize frames. With dropOldest set a
+// full queue discards its oldest frame, otherwise SendMessage fails with ErrSendQueueFull.
+func NewChatClient(id int, deviceID string, tokenID string, connection *websocket.Conn, salt string, bufferSize int, dropOldest bool) *ChatClient {
+	return &ChatClient{
+		ID:          id,
+		SessionID:   uuid.New().String(),
+		DeviceID:    deviceID,
+		TokenID:     tokenID,
+		ConnectedAt: time.Now(),
+		Connection:  connection,
+		Online:      true,
+		Salt:        salt,
+		Sent:        make(map[int]bool),
+		send:        make(chan outboundFrame, bufferSize),
+		dropOldest:  dropOldest,
+	}
+}
+
+func (c *ChatClient) Session() Session {
+	return Session{SessionID: c.SessionID, DeviceID: c.DeviceID, ConnectedAt: c.ConnectedAt}
+}
+
+// SendMessage queues a frame for the client's writer goroutine without blocking.
 func (c *ChatClient) SendMessage(messageType int, message []byte) error {
-	return c.Connection.WriteMessage(messageType, message)
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	frame := outboundFrame{messageType: messageType, data: message}
+	for {
+		select {
+		case c.send <- frame:
+			return nil
+		default:
+		}
+		if !c.dropOldest {
+			return ErrSendQueueFull
+		}
+		select {
+		case <-c.send:
+			log.Printf("Send queue of ChatClient %d is full, dropped oldest frame", c.ID)
+		default:
+		}
+	}
+}
+
+// WritePump writes queued frames to the connection and pings the client every pingInterval
+// until the client is closed or a write does not complete within writeTimeout.
+func (c *ChatClient) WritePump(pingInterval time.Duration, writeTimeout time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.Connection.Close()
+	}()
+	for {
+		select {
+		case frame, ok := <-c.send:
+			c.Connection.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if !ok {
+				c.Connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := c.Connection.WriteMessage(frame.messageType, frame.data); err != nil {
+				log.Printf("Error writing to WebSocket of ChatClient %d: %v", c.ID, err)
+				return
+			}
+		case <-ticker.C:
+			c.Connection.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.Connection.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("Error pinging ChatClient %d: %v", c.ID, err)
+				return
+			}
+		}
+	}
+}
+
+// KeepAliveFor makes reads on the connection fail unless the client sends a frame or answers
+// a ping within timeout, so that half-open connections are detected.
+func (c *ChatClient) KeepAliveFor(timeout time.Duration) {
+	c.Connection.SetReadDeadline(time.Now().Add(timeout))
+	c.Connection.SetPongHandler(func(string) error {
+		return c.Connection.SetReadDeadline(time.Now().Add(timeout))
+	})
+}
+
+// Close stops the writer goroutine once the frames queued so far have been written.
+func (c *ChatClient) Close() {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
 }
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectedPair returns the server side and the client side of a WebSocket connection.
+func connectedPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		connection, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		accepted <- connection
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return <-accepted, peer
+}
+
+// fillQueue queues frames "0" to "count-1" while nothing drains the queue, like a reader that stalled.
+func fillQueue(client *ChatClient, count int) []error {
+	var errs []error
+	for i := 0; i < count; i++ {
+		errs = append(errs, client.SendMessage(websocket.TextMessage, []byte(fmt.Sprint(i))))
+	}
+	return errs
+}
+
+// readAll returns the frames the peer receives until the connection is closed.
+func readAll(peer *websocket.Conn, t *testing.T) []string {
+	var frames []string
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := peer.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Fatalf("connection ended with %v", err)
+			}
+			return frames
+		}
+		frames = append(frames, string(data))
+	}
+}
+
+func TestSendQueueDropClient(t *testing.T) {
+	connection, peer := connectedPair(t)
+	client := NewChatClient(1, "default", "", connection, "", 3, false)
+
+	errs := fillQueue(client, 5)
+	for i, err := range errs {
+		if i < 3 && err != nil {
+			t.Fatalf("frame %d was not queued: %v", i, err)
+		}
+		if i >= 3 && !errors.Is(err, ErrSendQueueFull) {
+			t.Fatalf("expected frame %d to overflow the queue, got %v", i, err)
+		}
+	}
+
+	// The frames queued before the overflow are still written, followed by a close frame
+	go client.WritePump(time.Minute, time.Second)
+	client.Close()
+	if frames := readAll(peer, t); strings.Join(frames, ",") != "0,1,2" {
+		t.Fatalf("expected frames 0,1,2, got %v", frames)
+	}
+	if err := client.SendMessage(websocket.TextMessage, []byte("late")); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected a closed client to refuse frames, got %v", err)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	connection, peer := connectedPair(t)
+	client := NewChatClient(1, "default", "", connection, "", 3, true)
+
+	for i, err := range fillQueue(client, 5) {
+		if err != nil {
+			t.Fatalf("frame %d was not queued: %v", i, err)
+		}
+	}
+
+	go client.WritePump(time.Minute, time.Second)
+	client.Close()
+	if frames := readAll(peer, t); strings.Join(frames, ",") != "2,3,4" {
+		t.Fatalf("expected the newest frames 2,3,4, got %v", frames)
+	}
+}
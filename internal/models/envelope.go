@@ -0,0 +1,45 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// ProtocolV1 is the WebSocket subprotocol clients have to request in Sec-WebSocket-Protocol.
+const ProtocolV1 = "chat.v1"
+
+const (
+	FrameTypeMessage   = "message"
+	FrameTypeAck       = "ack"
+	FrameTypeDelivered = "delivered"
+	FrameTypeHistory   = "history"
+	FrameTypeSync      = "sync"
+	FrameTypeDelete    = "delete"
+	FrameTypeError     = "error"
+)
+
+const (
+	ErrorCodeMalformedFrame   = "malformed_frame"
+	ErrorCodeUnknownType      = "unknown_type"
+	ErrorCodeInvalidHash      = "invalid_hash"
+	ErrorCodeSenderMismatch   = "sender_mismatch"
+	ErrorCodeStaleTimestamp   = "stale_timestamp"
+	ErrorCodeReplayed         = "replayed_message"
+	ErrorCodeUnknownRecipient = "unknown_recipient"
+	ErrorCodeNotMember        = "not_member"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeInternal         = "internal_error"
+)
+
+// Envelope wraps every frame exchanged on the WebSocket. ID is chosen by whoever sends a
+// request and echoed in the frames that answer it.
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,59 @@
+package models
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 100
+)
+
+// HistoryQuery selects a page of a chat's history. Before and After are message IDs,
+// BeforeSeq and AfterSeq sequence numbers, BeforeMs and AfterMs are timestamps; zero
+// values leave the respective bound open. Without a lower bound the page ends at the
+// newest matching message, otherwise it starts right after the lower bound.
+type HistoryQuery struct {
+	ChatID    string `json:"chatId"`
+	Before    int    `json:"before,omitempty"`
+	After     int    `json:"after,omitempty"`
+	BeforeSeq int    `json:"beforeSeq,omitempty"`
+	AfterSeq  int    `json:"afterSeq,omitempty"`
+	BeforeMs  int64  `json:"beforeMs,omitempty"`
+	AfterMs   int64  `json:"afterMs,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// SyncRequest asks for the messages of a chat after the last sequence number a client has seen.
+// BeforeSeq may close the range at the next number the client has, zero reads up to the newest.
+type SyncRequest struct {
+	ChatID    string `json:"chatId"`
+	AfterSeq  int    `json:"afterSeq"`
+	BeforeSeq int    `json:"beforeSeq,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// HistoryQuery reads the requested range from its start.
+func (request SyncRequest) HistoryQuery() HistoryQuery {
+	return HistoryQuery{ChatID: request.ChatID, AfterSeq: request.AfterSeq, BeforeSeq: request.BeforeSeq, Limit: request.Limit}
+}
+
+// Normalize clamps the page size to the allowed range.
+func (query *HistoryQuery) Normalize() {
+	if query.Limit <= 0 {
+		query.Limit = DefaultHistoryLimit
+	}
+	if query.Limit > MaxHistoryLimit {
+		query.Limit = MaxHistoryLimit
+	}
+}
+
+// Forward reports whether the page is read from a lower bound towards newer messages.
+func (query *HistoryQuery) Forward() bool {
+	return query.After != 0 || query.AfterSeq != 0 || query.AfterMs != 0
+}
+
+// HistoryPage holds messages oldest first. HasMore tells whether further messages exist
+// in the direction the page was read, LastSeq is the newest sequence number of the chat.
+type HistoryPage struct {
+	ChatID   string    `json:"chatId"`
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"hasMore"`
+	LastSeq  int       `json:"lastSeq"`
+}
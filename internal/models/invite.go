@@ -0,0 +1,14 @@
+package models
+
+// Invite is a registration code. It can be used MaxUses times until it expires or is revoked.
+// ExpiresAt is a unix timestamp in seconds, 0 means the invite never expires.
+type Invite struct {
+	ID        int    `json:"id"`
+	Code      string `json:"code"`
+	CreatedBy int    `json:"createdBy,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	MaxUses   int    `json:"maxUses"`
+	Uses      int    `json:"uses"`
+	Revoked   bool   `json:"revoked"`
+}
@@ -1,11 +1,22 @@
 package models
 
 type Message struct {
+	ID           int    `json:"id,omitempty"`
 	ClientID     int    `json:"clientId"`
 	ChatID       string `json:"chatId"`
+	RecipientID  int    `json:"recipientId,omitempty"`
+	Recipient    string `json:"recipient,omitempty"`
 	Text         string `json:"text"`
 	Timestamp_ms int64  `json:"timestamp_ms"`
-	Hash         string `json:"hash"`
+	// Nonce is chosen by the client and must be unique per message, it makes every signature unique
+	Nonce string `json:"nonce,omitempty"`
+	// IdempotencyKey is chosen by the client and stays the same when a message is sent again, the
+	// server stores the message only once per key and sender
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	Hash           string `json:"hash"`
+	// Seq is assigned by the server and counts the messages of a chat without reusing a number,
+	// a gap tells a client which messages it missed
+	Seq int `json:"seq,omitempty"`
 }
 
 type DBMessage struct {
@@ -15,4 +26,18 @@ type DBMessage struct {
 	Text         string `json:"text"`
 	Timestamp_ms int64  `json:"timestamp"`
 	Hash         string `json:"hash"`
+	Seq          int    `json:"seq"`
+}
+
+// Message converts the stored message into the form that is sent to clients.
+func (message DBMessage) Message() Message {
+	return Message{
+		ID:           message.DBID,
+		ClientID:     message.ClientID,
+		ChatID:       message.ChatID,
+		Text:         message.Text,
+		Timestamp_ms: message.Timestamp_ms,
+		Hash:         message.Hash,
+		Seq:          message.Seq,
+	}
 }
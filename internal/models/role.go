@@ -0,0 +1,40 @@
+package models
+
+// Server roles apply to everything on the server.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Chat roles apply within a single chat, the creator of a group chat is its owner.
+const (
+	ChatRoleOwner     = "owner"
+	ChatRoleModerator = "moderator"
+	ChatRoleMember    = "member"
+)
+
+// Roles holds a client's server role and its role in one chat. Chat is empty if the client is
+// not a member of the chat or no chat is involved.
+type Roles struct {
+	Server string
+	Chat   string
+}
+
+func IsServerRole(role string) bool {
+	return role == RoleAdmin || role == RoleModerator || role == RoleMember
+}
+
+func IsChatRole(role string) bool {
+	return role == ChatRoleOwner || role == ChatRoleModerator || role == ChatRoleMember
+}
+
+// AuditEntry records a privileged action. ChatID and Target are empty if they do not apply.
+type AuditEntry struct {
+	ID        int    `json:"id"`
+	ActorID   int    `json:"actorId"`
+	Action    string `json:"action"`
+	ChatID    string `json:"chatId,omitempty"`
+	Target    string `json:"target,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
@@ -0,0 +1,84 @@
+package permissions
+
+import (
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"slices"
+)
+
+var ErrForbidden = errors.New("permission denied")
+
+type Action string
+
+const (
+	// Chat actions, granted by the chat role or the server role
+	SendMessage   Action = "send_message"
+	InviteMember  Action = "invite_member"
+	KickMember    Action = "kick_member"
+	DeleteMessage Action = "delete_message"
+	SetChatRole   Action = "set_chat_role"
+
+	// Server actions, granted by the server role only
+	ManageInvites Action = "manage_invites"
+	SetServerRole Action = "set_server_role"
+	ReadAuditLog  Action = "read_audit_log"
+)
+
+// DeleteMessage is about other people's messages, everyone may delete their own.
+var serverGrants = map[string][]Action{
+	models.RoleAdmin:     {SendMessage, InviteMember, KickMember, DeleteMessage, SetChatRole, ManageInvites, SetServerRole, ReadAuditLog},
+	models.RoleModerator: {KickMember, DeleteMessage, ReadAuditLog},
+}
+
+var chatGrants = map[string][]Action{
+	models.ChatRoleOwner:     {SendMessage, InviteMember, KickMember, DeleteMessage, SetChatRole},
+	models.ChatRoleModerator: {SendMessage, InviteMember, KickMember, DeleteMessage},
+	models.ChatRoleMember:    {SendMessage, InviteMember},
+}
+
+var chatRank = map[string]int{
+	models.ChatRoleMember:    1,
+	models.ChatRoleModerator: 2,
+	models.ChatRoleOwner:     3,
+}
+
+func Allowed(roles models.Roles, action Action) bool {
+	return slices.Contains(serverGrants[roles.Server], action) || slices.Contains(chatGrants[roles.Chat], action)
+}
+
+// Outranks reports whether a client with the given roles may act on a chat member with the target
+// chat role, e.g. kick them. Server admins and moderators outrank every chat role.
+func Outranks(roles models.Roles, targetChatRole string) bool {
+	if roles.Server == models.RoleAdmin || roles.Server == models.RoleModerator {
+		return true
+	}
+	return chatRank[roles.Chat] > chatRank[targetChatRole]
+}
+
+// Authorize loads the client's roles for the chat and checks the action against them. Pass an
+// empty chat ID for server actions. The roles are returned for follow-up checks like Outranks.
+func Authorize(database storage.Store, clientID int, chatID string, action Action) (models.Roles, error) {
+	roles, err := database.GetRoles(clientID, chatID)
+	if err != nil {
+		return roles, err
+	}
+	if !Allowed(roles, action) {
+		return roles, ErrForbidden
+	}
+	return roles, nil
+}
+
+// AuthorizeMessageDeletion checks that the client may delete the message and returns its chat.
+// Authors may always delete their own messages.
+func AuthorizeMessageDeletion(database storage.Store, clientID int, messageID int) (string, error) {
+	chatID, authorID, err := database.GetMessageAuthor(messageID)
+	if err != nil {
+		return "", err
+	}
+	if authorID == clientID {
+		return chatID, nil
+	}
+	_, err = Authorize(database, clientID, chatID, DeleteMessage)
+	return chatID, err
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/permissions"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"github.com/gorilla/websocket"
+	"log"
+	"strconv"
+	"time"
+)
+
+// frameHandler processes one incoming frame of a particular type.
+type frameHandler func(chatClient *models.ChatClient, envelope models.Envelope)
+
+func encodeFrame(frameType string, id string, payload interface{}) ([]byte, error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(models.Envelope{Type: frameType, ID: id, Payload: payloadJSON})
+}
+
+func (server *Server) sendFrame(chatClient *models.ChatClient, frameType string, id string, payload interface{}) {
+	frame, err := encodeFrame(frameType, id, payload)
+	if err != nil {
+		log.Printf("Error marshaling %s frame to JSON: %v", frameType, err)
+		return
+	}
+	if err := chatClient.SendMessage(websocket.TextMessage, frame); err != nil {
+		log.Printf("Dropping ChatClient %d while sending %s frame: %v", chatClient.ID, frameType, err)
+		chatClient.Connection.Close()
+	}
+}
+
+func (server *Server) sendError(chatClient *models.ChatClient, id string, code string, message string) {
+	log.Printf("Sending %s error to chatClient %d: %s", code, chatClient.ID, message)
+	server.sendFrame(chatClient, models.FrameTypeError, id, models.ErrorPayload{Code: code, Message: message})
+}
+
+func (server *Server) readMessages(chatClient *models.ChatClient) {
+	for {
+		_, message, err := chatClient.Connection.ReadMessage()
+		if err != nil {
+			log.Printf("Reading from ChatClient %d failed: %v", chatClient.ID, err)
+			break
+		}
+		// Any frame proves the client is alive, not just pongs
+		chatClient.Connection.SetReadDeadline(time.Now().Add(server.config.Server.PongTimeout))
+		var envelope models.Envelope
+		if err := json.Unmarshal(message, &envelope); err != nil {
+			server.sendError(chatClient, "", models.ErrorCodeMalformedFrame, "frame is not a valid envelope")
+			continue
+		}
+		handler, ok := server.frameHandlers[envelope.Type]
+		if !ok {
+			server.sendError(chatClient, envelope.ID, models.ErrorCodeUnknownType, fmt.Sprintf("unknown frame type %q", envelope.Type))
+			continue
+		}
+		handler(chatClient, envelope)
+	}
+}
+
+func (server *Server) handleChatMessage(chatClient *models.ChatClient, envelope models.Envelope) {
+	var msg models.Message
+	if err := json.Unmarshal(envelope.Payload, &msg); err != nil {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeMalformedFrame, "payload is not a valid message")
+		return
+	}
+
+	// The sender is whoever authenticated the connection. A payload naming someone else is rejected
+	// rather than corrected, since it was signed for that other sender.
+	if msg.ClientID != 0 && msg.ClientID != chatClient.ID {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeSenderMismatch, fmt.Sprintf("connection is authenticated as client %d", chatClient.ID))
+		return
+	}
+	if msg.Nonce == "" || len(msg.Nonce) > maxNonceLength {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeMalformedFrame, "message needs a nonce")
+		return
+	}
+	if len(msg.IdempotencyKey) > maxIdempotencyKeyLength {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeMalformedFrame, "idempotency key is too long")
+		return
+	}
+	if !authentication.VerifyMessage(msg, chatClient.Salt) {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeInvalidHash, "invalid hash")
+		return
+	}
+	// A message sent again is answered before the skew and nonce checks, which reject resent frames
+	if msg.IdempotencyKey != "" {
+		original, err := server.database.GetMessageByKey(chatClient.ID, msg.IdempotencyKey)
+		if err == nil {
+			server.sendFrame(chatClient, models.FrameTypeAck, envelope.ID, original)
+			return
+		}
+		if !errors.Is(err, storage.ErrMessageNotFound) {
+			log.Printf("Failed to look up idempotency key of chatClient %d: %v", chatClient.ID, err)
+			server.sendError(chatClient, envelope.ID, models.ErrorCodeInternal, "message could not be stored")
+			return
+		}
+	}
+	// Only signed messages reach the skew and nonce checks, so nobody can burn another client's nonces
+	now := time.Now()
+	skew := now.Sub(time.UnixMilli(msg.Timestamp_ms))
+	if skew > server.config.Limits.MessageClockSkew || -skew > server.config.Limits.MessageClockSkew {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeStaleTimestamp, "timestamp outside the accepted clock skew")
+		return
+	}
+	if !server.nonces.remember(chatClient.ID, msg.Nonce, now) {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeReplayed, "nonce was already used")
+		return
+	}
+	msg.ClientID = chatClient.ID
+
+	isMember, err := server.resolveChat(&msg, chatClient.ID)
+	if errors.Is(err, errUnknownRecipient) {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeUnknownRecipient, "unknown recipient")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to resolve chat %s for chatClient %d: %v", msg.ChatID, chatClient.ID, err)
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeInternal, "message could not be routed")
+		return
+	}
+	if !isMember {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeNotMember, fmt.Sprintf("not a member of chat %s", msg.ChatID))
+		return
+	}
+	_, err = permissions.Authorize(server.database, chatClient.ID, msg.ChatID, permissions.SendMessage)
+	if errors.Is(err, permissions.ErrForbidden) {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeForbidden, fmt.Sprintf("not allowed to send messages to chat %s", msg.ChatID))
+		return
+	}
+	if err != nil {
+		log.Printf("Checking permissions of chatClient %d in chat %s failed: %v", chatClient.ID, msg.ChatID, err)
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeInternal, "message could not be routed")
+		return
+	}
+
+	log.Printf("Received message from chatClient %d at %s: %s\n", chatClient.ID, time.Now().Format(time.RFC3339), msg.Text)
+	ack, err := server.storeMessage(msg, chatClient.SessionID)
+	if err != nil && !errors.Is(err, storage.ErrDuplicateMessage) {
+		log.Printf("Failed to store message! Error: %v", err)
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeInternal, "message could not be stored")
+		return
+	}
+	// The sending device has the message, only the client's other devices replay it
+	if err := server.database.AdvanceDeviceCursor(chatClient.ID, chatClient.DeviceID, ack.MessageID); err != nil {
+		log.Printf("Failed to advance cursor of device %s of chatClient %d: %v", chatClient.DeviceID, chatClient.ID, err)
+	}
+	server.sendFrame(chatClient, models.FrameTypeAck, envelope.ID, ack)
+}
+
+// handleDeliveryAck records that a recipient has received a message on the session's device.
+func (server *Server) handleDeliveryAck(chatClient *models.ChatClient, envelope models.Envelope) {
+	var deliveryAck models.DeliveryAck
+	if err := json.Unmarshal(envelope.Payload, &deliveryAck); err != nil {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeMalformedFrame, "payload is not a valid delivery acknowledgment")
+		return
+	}
+	if _, err := server.database.MarkMessageDelivered(deliveryAck.MessageID, chatClient.ID); err != nil {
+		log.Printf("Failed to mark message %d as delivered to chatClient %d: %v", deliveryAck.MessageID, chatClient.ID, err)
+		return
+	}
+	if err := server.database.AdvanceDeviceCursor(chatClient.ID, chatClient.DeviceID, deliveryAck.MessageID); err != nil {
+		log.Printf("Failed to advance cursor of device %s of chatClient %d: %v", chatClient.DeviceID, chatClient.ID, err)
+	}
+}
+
+// handleDeleteRequest deletes a message if the client wrote it or its roles allow deleting other people's messages.
+func (server *Server) handleDeleteRequest(chatClient *models.ChatClient, envelope models.Envelope) {
+	var deleteRequest models.DeleteRequest
+	if err := json.Unmarshal(envelope.Payload, &deleteRequest); err != nil {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeMalformedFrame, "payload is not a valid delete request")
+		return
+	}
+	chatID, err := permissions.AuthorizeMessageDeletion(server.database, chatClient.ID, deleteRequest.MessageID)
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeNotFound, "message not found")
+		return
+	}
+	if errors.Is(err, permissions.ErrForbidden) {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeForbidden, "not allowed to delete this message")
+		return
+	}
+	if err == nil {
+		err = server.database.DeleteMessage(deleteRequest.MessageID)
+	}
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete message %d for chatClient %d: %v", deleteRequest.MessageID, chatClient.ID, err)
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeInternal, "message could not be deleted")
+		return
+	}
+	if err := server.database.RecordAudit(chatClient.ID, string(permissions.DeleteMessage), chatID, strconv.Itoa(deleteRequest.MessageID)); err != nil {
+		log.Printf("Failed to record deletion of message %d: %v", deleteRequest.MessageID, err)
+	}
+	server.sendFrame(chatClient, models.FrameTypeAck, envelope.ID, models.Acknowledgment{
+		MessageID:    deleteRequest.MessageID,
+		ChatID:       chatID,
+		Timestamp_ms: time.Now().UnixMilli(),
+	})
+}
+
+// handleHistoryRequest answers with one page of a chat's history, see models.HistoryQuery.
+func (server *Server) handleHistoryRequest(chatClient *models.ChatClient, envelope models.Envelope) {
+	var query models.HistoryQuery
+	if err := json.Unmarshal(envelope.Payload, &query); err != nil {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeMalformedFrame, "payload is not a valid history query")
+		return
+	}
+	server.sendHistoryPage(chatClient, envelope, models.FrameTypeHistory, query)
+}
+
+// handleSyncRequest answers with the messages a client missed after the sequence number it names,
+// oldest first. A page with HasMore set is followed up with a sync after its last message.
+func (server *Server) handleSyncRequest(chatClient *models.ChatClient, envelope models.Envelope) {
+	var syncRequest models.SyncRequest
+	if err := json.Unmarshal(envelope.Payload, &syncRequest); err != nil || syncRequest.AfterSeq < 0 {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeMalformedFrame, "payload is not a valid sync request")
+		return
+	}
+	server.sendHistoryPage(chatClient, envelope, models.FrameTypeSync, syncRequest.HistoryQuery())
+}
+
+// sendHistoryPage answers the frame with the page the query selects if the client is a member of the chat.
+func (server *Server) sendHistoryPage(chatClient *models.ChatClient, envelope models.Envelope, frameType string, query models.HistoryQuery) {
+	members, err := server.chatMembers(query.ChatID)
+	if err != nil {
+		log.Printf("Failed to load members of chat %s: %v", query.ChatID, err)
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeInternal, "history could not be loaded")
+		return
+	}
+	if !members[chatClient.ID] {
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeNotMember, fmt.Sprintf("not a member of chat %s", query.ChatID))
+		return
+	}
+	page, err := server.database.RetrieveMessageHistory(query)
+	if err != nil {
+		log.Printf("Failed to load history of chat %s: %v", query.ChatID, err)
+		server.sendError(chatClient, envelope.ID, models.ErrorCodeInternal, "history could not be loaded")
+		return
+	}
+	server.sendFrame(chatClient, frameType, envelope.ID, page)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// maxNonceLength and maxIdempotencyKeyLength bound what a client can make the server remember per message.
+const (
+	maxNonceLength          = 128
+	maxIdempotencyKeyLength = 128
+)
+
+// nonceCache remembers the nonces seen within the accepted clock skew. A message older than the
+// skew is rejected by its timestamp, so its nonce can be forgotten after twice the skew.
+type nonceCache struct {
+	mutex     sync.Mutex
+	seen      map[nonceKey]time.Time
+	retention time.Duration
+	lastPrune time.Time
+}
+
+type nonceKey struct {
+	clientID int
+	nonce    string
+}
+
+func newNonceCache(skew time.Duration) *nonceCache {
+	return &nonceCache{
+		seen:      make(map[nonceKey]time.Time),
+		retention: 2 * skew,
+		lastPrune: time.Now(),
+	}
+}
+
+// remember records the nonce and reports whether it was unused.
+func (cache *nonceCache) remember(clientID int, nonce string, now time.Time) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if now.Sub(cache.lastPrune) > cache.retention {
+		for key, seenAt := range cache.seen {
+			if now.Sub(seenAt) > cache.retention {
+				delete(cache.seen, key)
+			}
+		}
+		cache.lastPrune = now
+	}
+	key := nonceKey{clientID: clientID, nonce: nonce}
+	if seenAt, ok := cache.seen[key]; ok && now.Sub(seenAt) <= cache.retention {
+		return false
+	}
+	cache.seen[key] = now
+	return true
+}
@@ -1,104 +1,220 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Schwarf/prototype_chat_server/internal/authentication"
 	"github.com/Schwarf/prototype_chat_server/internal/handlers"
 	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/permissions"
 	"github.com/Schwarf/prototype_chat_server/internal/storage"
 	"github.com/Schwarf/prototype_chat_server/pkg/config"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
 	"time"
 )
 
+var errUnknownRecipient = errors.New("unknown recipient")
+
+const (
+	// outboxBatchSize is how many outbox entries are read at once
+	outboxBatchSize = 100
+	// outboxPollInterval bounds how long entries that were not announced, for example those left
+	// by a previous run, wait for their fan-out
+	outboxPollInterval = time.Second
+)
+
 type Server struct {
-	config    *config.ServerConfig
-	clients   map[*models.ChatClient]bool
-	broadcast chan models.Message
-	mutex     sync.Mutex
-	database  *storage.DB
-	upgrader  websocket.Upgrader
-}
-
-func NewServer(serverConfig *config.ServerConfig, dataBase *storage.DB) *Server {
-	return &Server{
-		config:    serverConfig,
-		clients:   make(map[*models.ChatClient]bool),
-		broadcast: make(chan models.Message),
-		database:  dataBase,
+	config  *config.Config
+	clients map[*models.ChatClient]bool
+	chats   *models.ChatIndex
+	// outboxReady announces new outbox entries to the delivery worker
+	outboxReady   chan struct{}
+	stopped       chan struct{}
+	mutex         sync.Mutex
+	database      storage.Store
+	upgrader      websocket.Upgrader
+	frameHandlers map[string]frameHandler
+	nonces        *nonceCache
+}
+
+func NewServer(serverConfig *config.Config, dataBase storage.Store) *Server {
+	server := &Server{
+		config:      serverConfig,
+		clients:     make(map[*models.ChatClient]bool),
+		chats:       models.NewChatIndex(),
+		outboxReady: make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+		database:    dataBase,
+		nonces:      newNonceCache(serverConfig.Limits.MessageClockSkew),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			Subprotocols:    []string{models.ProtocolV1},
 			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
 	}
+	authentication.SetTokenLifetimes(serverConfig.Auth.AccessTokenTTL, serverConfig.Auth.RefreshTokenTTL)
+	authentication.SetLoginLockout(serverConfig.Limits.LoginMaxFailures, serverConfig.Limits.LoginLockout)
+	revokedTokens, err := dataBase.LoadRevokedTokens()
+	if err != nil {
+		log.Printf("Failed to load revoked tokens: %v", err)
+	}
+	authentication.LoadRevokedTokens(revokedTokens)
+
+	server.frameHandlers = map[string]frameHandler{
+		models.FrameTypeMessage:   server.handleChatMessage,
+		models.FrameTypeDelivered: server.handleDeliveryAck,
+		models.FrameTypeHistory:   server.handleHistoryRequest,
+		models.FrameTypeSync:      server.handleSyncRequest,
+		models.FrameTypeDelete:    server.handleDeleteRequest,
+	}
+	return server
 }
 
 func (server *Server) homepage(writer http.ResponseWriter, request *http.Request) {
 	fmt.Fprintf(writer, "Welcome to Schwarf'server WebSocket chat server!")
 }
 
-func (server *Server) broadcastMessage(message models.Message) {
+// chatMembers returns the member set of a chat, loading it from the database
+// into the chat index on first use.
+func (server *Server) chatMembers(chatID string) (map[int]bool, error) {
+	if members, ok := server.chats.Members(chatID); ok {
+		return members, nil
+	}
+	clientIDs, err := server.database.GetChatMembers(chatID)
+	if err != nil {
+		return nil, err
+	}
+	server.chats.SetMembers(chatID, clientIDs)
+	members, _ := server.chats.Members(chatID)
+	return members, nil
+}
+
+// deliverMessage queues a stored message for a client. The message stays pending for the client
+// until the client acknowledges it. The caller must hold server.mutex.
+func (server *Server) deliverMessage(client *models.ChatClient, payload []byte) {
+	if err := client.SendMessage(websocket.TextMessage, payload); err != nil {
+		log.Printf("Dropping ChatClient %d: %v", client.ID, err)
+		client.Online = false
+		// Closing the connection ends the client's read loop, which unregisters it
+		client.Connection.Close()
+	}
+}
+
+// broadcastMessage sends an outbox entry's message to the online sessions of its chat's members,
+// except the session it was sent from. Sessions that already received it are skipped.
+func (server *Server) broadcastMessage(entry storage.OutboxEntry) error {
+	message := entry.Message
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
+	members, err := server.chatMembers(message.ChatID)
+	if err != nil {
+		return fmt.Errorf("failed to load members of chat %s: %w", message.ChatID, err)
+	}
+	msgJSON, err := encodeFrame(models.FrameTypeMessage, "", message.Message())
+	if err != nil {
+		return fmt.Errorf("error marshaling message to JSON: %w", err)
+	}
 	for client := range server.clients {
-		if client.Online {
-			msgJSON, err := json.Marshal(message)
-			if err != nil {
-				log.Printf("Error marshaling message to JSON: %v", err)
-				continue
+		if client.Online && client.SessionID != entry.SenderSession && members[client.ID] && !client.Sent[message.DBID] {
+			server.deliverMessage(client, msgJSON)
+			client.Sent[message.DBID] = true
+		}
+	}
+	return nil
+}
+
+// forgetSent drops a message from the sessions' sent sets once its outbox entry is complete,
+// nothing sends it again afterwards.
+func (server *Server) forgetSent(messageID int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for client := range server.clients {
+		delete(client.Sent, messageID)
+	}
+}
+
+// announceOutbox wakes the delivery worker without waiting for it.
+func (server *Server) announceOutbox() {
+	select {
+	case server.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+// deliverOutbox fans out outbox entries until the server stops. An entry is only removed after its
+// fan-out, so the entries of a run that ended midway are delivered when the server starts again.
+func (server *Server) deliverOutbox() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		server.drainOutbox()
+		select {
+		case <-server.outboxReady:
+		case <-ticker.C:
+		case <-server.stopped:
+			return
+		}
+	}
+}
+
+func (server *Server) drainOutbox() {
+	for {
+		entries, err := server.database.PendingOutbox(outboxBatchSize)
+		if err != nil {
+			log.Printf("Failed to read outbox: %v", err)
+			return
+		}
+		for _, entry := range entries {
+			// A failed entry is retried on the next poll, later entries wait to keep the order
+			if err := server.broadcastMessage(entry); err != nil {
+				log.Printf("Fan-out of message %d failed: %v", entry.Message.DBID, err)
+				return
 			}
-			if err := client.SendMessage(websocket.TextMessage, msgJSON); err != nil {
-				log.Printf("Error writing to WebSocket: %v", err)
-				client.Online = false
+			if err := server.database.CompleteOutboxEntry(entry.ID); err != nil {
+				log.Printf("Failed to complete outbox entry %d: %v", entry.ID, err)
+				return
 			}
+			server.forgetSent(entry.Message.DBID)
+		}
+		if len(entries) < outboxBatchSize {
+			return
 		}
 	}
 }
 
-func (server *Server) retryUndeliveredMessages() {
+// deliverUndeliveredMessages sends a session everything addressed to its client that the session's
+// device has not acknowledged, including what the client wrote on other devices.
+func (server *Server) deliverUndeliveredMessages(chatClient *models.ChatClient) {
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
 
-	undeliveredMessages, err := storage.RetrieveUndeliveredMessages(server.database)
+	deliveredUpTo, err := server.database.GetDeviceCursor(chatClient.ID, chatClient.DeviceID)
 	if err != nil {
-		log.Printf("Failed to retrieve undelivered messages: %v", err)
+		log.Printf("Failed to get cursor of device %s of client %d: %v", chatClient.DeviceID, chatClient.ID, err)
+		return
+	}
+	undeliveredMessages, err := server.database.RetrieveUndeliveredMessages(chatClient.ID, chatClient.DeviceID, deliveredUpTo)
+	if err != nil {
+		log.Printf("Failed to retrieve undelivered messages for client %d: %v", chatClient.ID, err)
 		return
 	}
 
 	for _, message := range undeliveredMessages {
-		for client := range server.clients {
-			if client.Online {
-				msgJSON, err := json.Marshal(message)
-				if err != nil {
-					log.Printf("Error marshaling message to JSON: %v", err)
-					continue
-				}
-				if err := client.SendMessage(websocket.TextMessage, msgJSON); err != nil {
-					log.Printf("Error writing to WebSocket: %v", err)
-					client.Online = false
-				} else {
-					storage.UpdateMessageStatus(server.database, message.DBID, true)
-				}
-			}
+		if chatClient.Sent[message.DBID] {
+			continue
 		}
-	}
-}
-
-func (server *Server) handleMessages() {
-	for {
-		select {
-		case message := <-server.broadcast:
-			server.broadcastMessage(message)
-		case <-time.After(time.Second * 3):
-			server.retryUndeliveredMessages()
+		msgJSON, err := encodeFrame(models.FrameTypeMessage, "", message.Message())
+		if err != nil {
+			log.Printf("Error marshaling message to JSON: %v", err)
+			continue
 		}
+		server.deliverMessage(chatClient, msgJSON)
+		chatClient.Sent[message.DBID] = true
 	}
 }
 
@@ -110,19 +226,58 @@ func (server *Server) Start() error {
 	http.HandleFunc("/register", func(writer http.ResponseWriter, request *http.Request) {
 		handlers.RegisterClient(server.database, writer, request)
 	})
-	http.HandleFunc("/ws", server.websocketEndpoint)
-	log.Println("Starting server on port", server.config.Port)
-	go server.handleMessages()
-	return http.ListenAndServe(server.config.Port, nil)
+	http.HandleFunc("POST /login", func(writer http.ResponseWriter, request *http.Request) {
+		handlers.Login(server.database, writer, request)
+	})
+	http.HandleFunc("GET /oidc/login", handlers.OIDCLogin)
+	http.HandleFunc("GET /oidc/callback", func(writer http.ResponseWriter, request *http.Request) {
+		handlers.OIDCCallback(server.database, writer, request)
+	})
+	http.Handle("POST /password", server.authenticated(handlers.ChangePassword))
+	http.HandleFunc("GET /.well-known/jwks.json", handlers.JSONWebKeySet)
+	http.HandleFunc("POST /token/refresh", func(writer http.ResponseWriter, request *http.Request) {
+		handlers.RefreshToken(server.database, writer, request)
+	})
+	http.Handle("POST /token/revoke", server.authenticated(func(database storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+		handlers.RevokeToken(database, server.clients, &server.mutex, clientID, writer, request)
+	}))
+	http.Handle("POST /chats", server.authenticated(handlers.CreateChat))
+	http.Handle("POST /chats/{chatId}/invite", server.authenticated(handlers.InviteToChat))
+	http.Handle("POST /chats/{chatId}/join", server.authenticated(handlers.JoinChat))
+	http.Handle("POST /chats/{chatId}/leave", server.authenticated(handlers.LeaveChat))
+	http.Handle("GET /chats/{chatId}/members", server.authenticated(handlers.ListChatMembers))
+	http.Handle("POST /chats/{chatId}/kick", server.authenticated(handlers.KickMember))
+	http.Handle("PUT /chats/{chatId}/members/{clientId}/role", server.authenticated(handlers.SetChatRole))
+	http.Handle("DELETE /chats/{chatId}/messages/{messageId}", server.authenticated(handlers.DeleteMessage))
+	http.Handle("GET /chats/{chatId}/messages", server.authenticated(handlers.GetMessageHistory))
+	http.Handle("GET /sessions", server.authenticated(func(_ storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+		handlers.ListSessions(server.clients, &server.mutex, clientID, writer, request)
+	}))
+	http.Handle("DELETE /sessions/{sessionId}", server.authenticated(func(_ storage.Store, _ *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+		handlers.TerminateSession(server.clients, &server.mutex, clientID, writer, request)
+	}))
+	http.Handle("POST /admin/invites", server.authorized(permissions.ManageInvites, handlers.CreateInvite))
+	http.Handle("GET /admin/invites", server.authorized(permissions.ManageInvites, handlers.ListInvites))
+	http.Handle("DELETE /admin/invites/{inviteId}", server.authorized(permissions.ManageInvites, handlers.RevokeInvite))
+	http.Handle("PUT /admin/clients/{clientId}/role", server.authorized(permissions.SetServerRole, handlers.SetServerRole))
+	http.Handle("GET /admin/audit", server.authorized(permissions.ReadAuditLog, handlers.ListAuditLog))
+	http.Handle("/ws", authentication.AuthMiddleware(http.HandlerFunc(server.websocketEndpoint)))
+	log.Println("Starting server on port", server.config.Server.Port)
+	go server.deliverOutbox()
+	if server.config.TLS.Enabled() {
+		return http.ListenAndServeTLS(server.config.Server.Port, server.config.TLS.CertFile, server.config.TLS.KeyFile, nil)
+	}
+	return http.ListenAndServe(server.config.Server.Port, nil)
 }
 
 func (server *Server) Stop() error {
 	fmt.Println("Stopping server...")
+	close(server.stopped)
 
 	envVariable := os.Getenv("APP_ENV")
 	if envVariable != "" {
 		//Drop all tables in the database
-		if err := storage.DropAllTables(server.database.DB); err != nil {
+		if err := server.database.DropAllTables(); err != nil {
 			log.Printf("Failed to drop tables: %v", err)
 			return err
 		}
@@ -136,58 +291,65 @@ func (server *Server) Stop() error {
 	return nil
 }
 
-func (server *Server) storeMessage(message models.Message) error {
-	if err := storage.StoreMessage(server.database, message); err != nil {
+// storeMessage stores the message and hands it to the delivery worker. A duplicate is neither
+// stored nor delivered again, its original's acknowledgment is returned with ErrDuplicateMessage.
+func (server *Server) storeMessage(message models.Message, senderSession string) (*models.Acknowledgment, error) {
+	ack, err := server.database.StoreMessage(message, senderSession)
+	if errors.Is(err, storage.ErrDuplicateMessage) {
+		return ack, err
+	}
+	if err != nil {
 		log.Printf("Storing message failed! Error: %v", err)
-		return err
+		return nil, err
 	}
-	return nil
+	server.announceOutbox()
+	return ack, nil
 }
 
-func (server *Server) authenticateClient(request *http.Request, writer http.ResponseWriter) (int, string, error) {
-	authenticationHeader := request.Header.Get("Authorization")
-	if authenticationHeader == "" {
-		http.Error(writer, "Authorization header is missing", http.StatusUnauthorized)
-		return 0, "", fmt.Errorf("authorization header is missing")
+// authenticatedClient returns the ID of the client whose token AuthMiddleware verified for the request.
+func authenticatedClient(request *http.Request) (int, error) {
+	claims, ok := authentication.ClaimsFromContext(request.Context())
+	if !ok {
+		return 0, authentication.ErrInvalidToken
 	}
+	return claims.ClientID()
+}
 
-	token := strings.TrimPrefix(authenticationHeader, "Bearer ")
-	if token == "" {
-		log.Println("Missing token")
-		http.Error(writer, "Missing token", http.StatusUnauthorized)
-		return 0, "", fmt.Errorf("missing token")
-	}
-	clientID, salt, err := storage.GetClientIDAndSalt(server.database, token)
-	if err != nil {
-		log.Printf("Failed to get clientID by token: %v, %s", err, token)
-		http.Error(writer, "Invalid token", http.StatusUnauthorized)
-		return 0, "", fmt.Errorf("invalid token")
-	}
-	return clientID, salt, nil
+// authenticated wraps a chat handler so that it runs on behalf of the client owning the request's token.
+func (server *Server) authenticated(handler func(storage.Store, *models.ChatIndex, int, http.ResponseWriter, *http.Request)) http.Handler {
+	return authentication.AuthMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		clientID, err := authenticatedClient(request)
+		if err != nil {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		handler(server.database, server.chats, clientID, writer, request)
+	}))
 }
 
-func (server *Server) isClientAlreadyConnected(clientID int, connection *websocket.Conn) bool {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-	for client := range server.clients {
-		if client.ID == clientID {
-			log.Printf("Client %d is already connected. Declining new connection attempt.", clientID)
-			err := connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Client already connected"))
-			if err != nil {
-				log.Printf("Failed to notify client %d about existing connection: %v", clientID, err)
-			}
-			return true
+// authorized is authenticated for handlers of server actions, which need a server role that grants the action.
+func (server *Server) authorized(action permissions.Action, handler func(storage.Store, *models.ChatIndex, int, http.ResponseWriter, *http.Request)) http.Handler {
+	return server.authenticated(func(database storage.Store, chats *models.ChatIndex, clientID int, writer http.ResponseWriter, request *http.Request) {
+		_, err := permissions.Authorize(database, clientID, "", action)
+		if errors.Is(err, permissions.ErrForbidden) {
+			http.Error(writer, "Permission denied", http.StatusForbidden)
+			return
 		}
-	}
-	return false
+		if err != nil {
+			log.Printf("Checking permissions of client %d failed: %v", clientID, err)
+			http.Error(writer, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		handler(database, chats, clientID, writer, request)
+	})
 }
 
-func (server *Server) addChatClient(connection *websocket.Conn, clientID int) *models.ChatClient {
+func (server *Server) addChatClient(connection *websocket.Conn, clientID int, deviceID string, tokenID string, salt string) *models.ChatClient {
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
-	chatClient := &models.ChatClient{ID: clientID, Connection: connection, Online: true}
+	chatClient := models.NewChatClient(clientID, deviceID, tokenID, connection, salt, server.config.Limits.SendBufferSize, server.config.Limits.OverflowPolicy == config.OverflowDropOldest)
 	server.clients[chatClient] = true
-	log.Printf("Added connection for new ChatClient %d", clientID)
+	log.Printf("Added session %s on device %s for ChatClient %d", chatClient.SessionID, deviceID, clientID)
 	return chatClient
 }
 
@@ -195,60 +357,131 @@ func (server *Server) removeChatClient(chatClient *models.ChatClient) {
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
 	delete(server.clients, chatClient)
-	log.Printf("ChatClient %d disconnected", chatClient.ID)
+	log.Printf("Session %s of ChatClient %d disconnected", chatClient.SessionID, chatClient.ID)
 }
 
-func (server *Server) readMessages(chatClient *models.ChatClient, salt string) {
-	for {
-		_, message, err := chatClient.Connection.ReadMessage()
+// selfChatID names the private chat that messages without a chat ID are stored in.
+func selfChatID(clientID int) string {
+	return fmt.Sprintf("%s%d", models.SelfChatPrefix, clientID)
+}
+
+// directChatID names the one-to-one chat between two clients independently of who writes first.
+func directChatID(clientID int, recipientID int) string {
+	if recipientID < clientID {
+		clientID, recipientID = recipientID, clientID
+	}
+	return fmt.Sprintf("%s%d-%d", models.DirectChatPrefix, clientID, recipientID)
+}
+
+// resolveRecipient looks up the client a direct message is addressed to, by ID or by username.
+func (server *Server) resolveRecipient(message *models.Message) (int, error) {
+	if message.Recipient != "" {
+		recipientID, err := server.database.GetClientIDByUsername(message.Recipient)
 		if err != nil {
-			log.Println(err)
-			break
-		}
-		var msg models.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
-			continue
+			return 0, errUnknownRecipient
 		}
+		return recipientID, nil
+	}
+	exists, err := server.database.ClientExists(message.RecipientID)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errUnknownRecipient
+	}
+	return message.RecipientID, nil
+}
 
-		expectedHash := authentication.GenerateHash(msg.Text, salt)
-		if msg.Hash != expectedHash {
-			log.Printf("Invalid hash for message from chatClient %server", chatClient.ID)
-			continue
+// resolveChat fills in the chat of direct messages and the sender's self chat for messages
+// without a chat ID, and reports whether the sender is a member of the message's chat.
+func (server *Server) resolveChat(message *models.Message, senderID int) (bool, error) {
+	if message.Recipient != "" || message.RecipientID != 0 {
+		recipientID, err := server.resolveRecipient(message)
+		if err != nil {
+			return false, err
 		}
-
-		log.Printf("Received message from chatClient %d at %server: %server\n", chatClient.ID, time.Now().Format(time.RFC3339), message)
-		server.broadcast <- msg
-		if err := server.storeMessage(msg); err != nil {
-			log.Printf("Failed to store message! Error: %v", err)
+		if recipientID == senderID {
+			return false, errUnknownRecipient
 		}
-		ack := fmt.Sprintf("Message from chatClient %d received at %server", chatClient.ID, time.Now().Format(time.RFC3339))
-		if err := chatClient.SendMessage(websocket.TextMessage, []byte(ack)); err != nil {
-			log.Printf("Error sending acknowledgment to WebSocket: %v", err)
+		message.RecipientID = recipientID
+		message.ChatID = directChatID(senderID, recipientID)
+		if err := server.database.AddDirectChat(senderID, recipientID, message.ChatID); err != nil {
+			return false, err
 		}
+		server.chats.SetMembers(message.ChatID, []int{senderID, recipientID})
+	} else if message.ChatID == "" {
+		message.ChatID = selfChatID(senderID)
+		if err := server.database.AddChat(senderID, message.ChatID, models.ChatKindSelf); err != nil {
+			return false, err
+		}
+		server.chats.SetMembers(message.ChatID, []int{senderID})
 	}
+	members, err := server.chatMembers(message.ChatID)
+	if err != nil {
+		return false, err
+	}
+	return members[senderID], nil
+}
+
+// deviceID names the device a connection comes from, taken from the "device" query parameter
+// or the X-Device-ID header. Sessions from the same device share one delivery cursor.
+func deviceID(request *http.Request) string {
+	device := request.URL.Query().Get("device")
+	if device == "" {
+		device = request.Header.Get("X-Device-ID")
+	}
+	if device == "" {
+		return "default"
+	}
+	if len(device) > 64 {
+		return device[:64]
+	}
+	return device
+}
 
+// supportsProtocol reports whether the client offered a protocol version this server speaks.
+func (server *Server) supportsProtocol(request *http.Request) bool {
+	for _, offered := range websocket.Subprotocols(request) {
+		for _, supported := range server.upgrader.Subprotocols {
+			if offered == supported {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (server *Server) websocketEndpoint(writer http.ResponseWriter, request *http.Request) {
-	connection, err := server.upgrader.Upgrade(writer, request, nil)
+	if !server.supportsProtocol(request) {
+		log.Printf("Declining WebSocket connection without supported protocol: %v", websocket.Subprotocols(request))
+		http.Error(writer, fmt.Sprintf("Unsupported protocol, expected %s", models.ProtocolV1), http.StatusBadRequest)
+		return
+	}
+	claims, _ := authentication.ClaimsFromContext(request.Context())
+	clientID, err := authenticatedClient(request)
 	if err != nil {
-		log.Printf("Failed to upgrade to WebSocket: %v", err)
+		http.Error(writer, "Invalid token", http.StatusUnauthorized)
 		return
 	}
-	defer connection.Close()
-	clientID, salt, err := server.authenticateClient(request, writer)
+	salt, err := server.database.GetClientSalt(clientID)
 	if err != nil {
-		log.Printf("Failed to authenticate chatClient: %v", err)
+		log.Printf("Failed to authenticate chatClient %d: %v", clientID, err)
+		http.Error(writer, "Unknown client", http.StatusUnauthorized)
 		return
 	}
-
-	if server.isClientAlreadyConnected(clientID, connection) {
+	connection, err := server.upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade to WebSocket: %v", err)
 		return
 	}
+	defer connection.Close()
 
-	chatClient := server.addChatClient(connection, clientID)
+	chatClient := server.addChatClient(connection, clientID, deviceID(request), claims.ID, salt)
 	defer server.removeChatClient(chatClient)
+	chatClient.KeepAliveFor(server.config.Server.PongTimeout)
+	go chatClient.WritePump(server.config.Server.PingInterval, server.config.Server.WriteTimeout)
+	defer chatClient.Close()
+	server.deliverUndeliveredMessages(chatClient)
 
-	server.readMessages(chatClient, salt)
+	server.readMessages(chatClient)
 }
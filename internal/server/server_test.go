@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/internal/storage"
+	"github.com/Schwarf/prototype_chat_server/pkg/config"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectedPair returns the server side and the client side of a WebSocket connection.
+func connectedPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		connection, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		accepted <- connection
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return <-accepted, peer
+}
+
+// readMessageIDs returns the IDs of the message frames the peer receives until nothing arrives for a while.
+func readMessageIDs(peer *websocket.Conn, t *testing.T) []int {
+	var ids []int
+	for {
+		peer.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		var envelope models.Envelope
+		if err := peer.ReadJSON(&envelope); err != nil {
+			return ids
+		}
+		var message models.Message
+		if err := json.Unmarshal(envelope.Payload, &message); err != nil || envelope.Type != models.FrameTypeMessage {
+			t.Fatalf("expected a message frame, got %s: %s", envelope.Type, envelope.Payload)
+		}
+		ids = append(ids, message.ID)
+	}
+}
+
+func TestFanOutOfLowerIDAfterHigherID(t *testing.T) {
+	serverConfig := config.Defaults()
+	serverConfig.Database.Driver = config.DriverMemory
+	database, err := storage.ConnectToDatabase(&serverConfig.Database)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	server := NewServer(serverConfig, database)
+
+	sender, _ := database.AddClient("sender", "sender-salt")
+	recipient, _ := database.AddClient("recipient", "recipient-salt")
+	for _, chatID := range []string{"first", "second"} {
+		if err := database.CreateChat(sender, chatID, chatID, []int{recipient}); err != nil {
+			t.Fatalf("failed to create chat: %v", err)
+		}
+		if _, err := database.StoreMessage(models.Message{ClientID: sender, ChatID: chatID, Text: chatID}, "sender-session"); err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+	}
+	entries, err := database.PendingOutbox(outboxBatchSize)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected two outbox entries, got %+v, %v", entries, err)
+	}
+
+	connection, peer := connectedPair(t)
+	chatClient := server.addChatClient(connection, recipient, "phone", "", "recipient-salt")
+	go chatClient.WritePump(time.Minute, time.Second)
+	defer chatClient.Close()
+
+	// The message with the higher ID committed first, the lower one still has to arrive
+	for _, entry := range []storage.OutboxEntry{entries[1], entries[0]} {
+		if err := server.broadcastMessage(entry); err != nil {
+			t.Fatalf("failed to fan out message %d: %v", entry.Message.DBID, err)
+		}
+	}
+	first, second := entries[0].Message.DBID, entries[1].Message.DBID
+	if ids := readMessageIDs(peer, t); len(ids) != 2 || ids[0] != second || ids[1] != first {
+		t.Fatalf("expected messages %d and %d, got %v", second, first, ids)
+	}
+
+	// Neither the replay nor the worker sends them again, and completing the entries forgets them
+	server.deliverUndeliveredMessages(chatClient)
+	server.drainOutbox()
+	if ids := readMessageIDs(peer, t); len(ids) != 0 {
+		t.Fatalf("expected no message to be sent twice, got %v", ids)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(chatClient.Sent) != 0 {
+		t.Fatalf("expected the completed messages to be forgotten, got %v", chatClient.Sent)
+	}
+}
+
+// concurrentDeletion is a store in which someone else deletes a message just before the client does.
+type concurrentDeletion struct {
+	storage.Store
+}
+
+func (store concurrentDeletion) DeleteMessage(messageID int) error {
+	store.Store.DeleteMessage(messageID)
+	return store.Store.DeleteMessage(messageID)
+}
+
+func TestDeleteOfMessageDeletedMeanwhile(t *testing.T) {
+	serverConfig := config.Defaults()
+	serverConfig.Database.Driver = config.DriverMemory
+	database, err := storage.ConnectToDatabase(&serverConfig.Database)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	server := NewServer(serverConfig, concurrentDeletion{database})
+
+	author, _ := database.AddClient("author", "author-salt")
+	if err := database.CreateChat(author, "chat", "chat", nil); err != nil {
+		t.Fatalf("failed to create chat: %v", err)
+	}
+	ack, err := database.StoreMessage(models.Message{ClientID: author, ChatID: "chat", Text: "gone"}, "author-session")
+	if err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	connection, peer := connectedPair(t)
+	chatClient := server.addChatClient(connection, author, "phone", "", "author-salt")
+	go chatClient.WritePump(time.Minute, time.Second)
+	defer chatClient.Close()
+
+	payload, _ := json.Marshal(models.DeleteRequest{MessageID: ack.MessageID})
+	server.handleDeleteRequest(chatClient, models.Envelope{Type: models.FrameTypeDelete, ID: "delete-1", Payload: payload})
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var envelope models.Envelope
+	if err := peer.ReadJSON(&envelope); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	var reply models.ErrorPayload
+	if err := json.Unmarshal(envelope.Payload, &reply); err != nil || envelope.Type != models.FrameTypeError || reply.Code != models.ErrorCodeNotFound {
+		t.Fatalf("expected a not found error, got %s: %s", envelope.Type, envelope.Payload)
+	}
+	if entries, err := database.ListAuditLog(0, 10); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no audit entry, got %+v, %v", entries, err)
+	}
+}
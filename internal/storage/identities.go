@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"strconv"
+)
+
+// ProvisionIdentityClient returns the client linked to the identity provider's subject. On the
+// subject's first login a client is created under the first free variant of the username.
+func (db *sqlStore) ProvisionIdentityClient(issuer string, subject string, username string, salt string) (*models.Client, error) {
+	transaction, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	client := models.Client{}
+	query := `
+	SELECT clients.id, clients.username, clients.salt
+	FROM identities
+	JOIN clients ON clients.id = identities.client_id
+	WHERE identities.issuer = $1 AND identities.subject = $2;`
+	err = transaction.QueryRow(query, issuer, subject).Scan(&client.ID, &client.Username, &client.Salt)
+	if err == nil {
+		return &client, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to look up identity: %w", err)
+	}
+
+	client.Username = username
+	for suffix := 2; ; suffix++ {
+		var taken bool
+		err = transaction.QueryRow("SELECT EXISTS (SELECT 1 FROM clients WHERE username = $1)", client.Username).Scan(&taken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up username: %w", err)
+		}
+		if !taken {
+			break
+		}
+		client.Username = username + strconv.Itoa(suffix)
+	}
+	client.Salt = salt
+	err = transaction.QueryRow("INSERT INTO clients (username, salt) VALUES ($1, $2) RETURNING id", client.Username, client.Salt).Scan(&client.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add client: %w", err)
+	}
+	_, err = transaction.Exec("INSERT INTO identities (issuer, subject, client_id) VALUES ($1, $2, $3)", issuer, subject, client.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+	return &client, transaction.Commit()
+}
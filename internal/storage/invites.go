@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"time"
+)
+
+var (
+	ErrInviteInvalid  = errors.New("invite is unknown, used up, expired or revoked")
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrUsernameTaken  = errors.New("username is already taken")
+)
+
+// CreateInvite stores a new invite code. A zero expiresAt creates an invite that never expires.
+func (db *sqlStore) CreateInvite(code string, createdBy int, maxUses int, expiresAt time.Time) (*models.Invite, error) {
+	invite := models.Invite{Code: code, CreatedBy: createdBy, CreatedAt: time.Now().Unix(), MaxUses: maxUses}
+	if !expiresAt.IsZero() {
+		invite.ExpiresAt = expiresAt.Unix()
+	}
+	query := `
+	INSERT INTO secrets (secret, created_by, created_at, expires_at, max_uses)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id;`
+	err := db.QueryRow(query, code, createdBy, invite.CreatedAt, invite.ExpiresAt, maxUses).Scan(&invite.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invite: %w", err)
+	}
+	return &invite, nil
+}
+
+// SeedInvites stores single-use invites without a creator, codes that already exist are kept as they are.
+func (db *sqlStore) SeedInvites(codes []string) error {
+	for _, code := range codes {
+		query := `
+		INSERT INTO secrets (secret, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (secret) DO NOTHING;`
+		if _, err := db.Exec(query, code, time.Now().Unix()); err != nil {
+			return fmt.Errorf("failed to seed invite: %w", err)
+		}
+	}
+	return nil
+}
+
+func (db *sqlStore) ListInvites() ([]models.Invite, error) {
+	query := `
+	SELECT id, secret, COALESCE(created_by, 0), created_at, expires_at, max_uses, uses, revoked
+	FROM secrets
+	ORDER BY id;`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invites: %w", err)
+	}
+	defer rows.Close()
+
+	invites := []models.Invite{}
+	for rows.Next() {
+		var invite models.Invite
+		err := rows.Scan(&invite.ID, &invite.Code, &invite.CreatedBy, &invite.CreatedAt, &invite.ExpiresAt, &invite.MaxUses, &invite.Uses, &invite.Revoked)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan invite: %w", err)
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func (db *sqlStore) RevokeInvite(inviteID int) error {
+	result, err := db.Exec("UPDATE secrets SET revoked = true WHERE id = $1", inviteID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite: %w", err)
+	}
+	if affected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// RegisterClientWithInvite consumes one use of the invite and adds the client in the same
+// transaction, so an invite is only used up by a registration that succeeded.
+// The password hash may be empty for clients that only log in with their tokens.
+func (db *sqlStore) RegisterClientWithInvite(code string, username string, salt string, passwordHash string, role string) (int, error) {
+	transaction, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	query := `
+	UPDATE secrets SET uses = uses + 1
+	WHERE secret = $1 AND NOT revoked AND uses < max_uses AND (expires_at = 0 OR expires_at > $2)
+	RETURNING id;`
+	var inviteID int
+	err = transaction.QueryRow(query, code, time.Now().Unix()).Scan(&inviteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInviteInvalid
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume invite: %w", err)
+	}
+
+	var taken bool
+	err = transaction.QueryRow("SELECT EXISTS (SELECT 1 FROM clients WHERE username = $1)", username).Scan(&taken)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up username: %w", err)
+	}
+	if taken {
+		return 0, ErrUsernameTaken
+	}
+
+	var clientID int
+	err = transaction.QueryRow("INSERT INTO clients (username, salt, password_hash, role) VALUES ($1, $2, NULLIF($3, ''), $4) RETURNING id",
+		username, salt, passwordHash, role).
+		Scan(&clientID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add client: %w", err)
+	}
+	return clientID, transaction.Commit()
+}
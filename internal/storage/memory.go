@@ -0,0 +1,904 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryClient struct {
+	client       models.Client
+	role         string
+	passwordHash string
+	failedLogins int
+	lockedUntil  int64
+}
+
+type memoryChat struct {
+	chat models.Chat
+	// members maps each member to its role in the chat
+	members map[int]string
+	// invitations maps each invited client to the client who invited it
+	invitations map[int]int
+	lastSeq     int
+}
+
+type memoryRefreshToken struct {
+	clientID  int
+	expiresAt int64
+	revoked   bool
+}
+
+type identity struct {
+	issuer  string
+	subject string
+}
+
+type device struct {
+	clientID int
+	deviceID string
+}
+
+type idempotencyKey struct {
+	clientID int
+	key      string
+}
+
+// memoryStore keeps everything in maps guarded by one mutex. It loses all data when the server
+// stops and is meant for tests and trying the server out.
+type memoryStore struct {
+	mutex   sync.Mutex
+	created time.Time
+
+	clients    map[int]*memoryClient
+	usernames  map[string]int
+	identities map[identity]int
+
+	chats map[string]*memoryChat
+	// messages are ordered by ID
+	messages []models.DBMessage
+	// deliveries maps each message to its recipients and whether they acknowledged it
+	deliveries    map[int]map[int]bool
+	deviceCursors map[device]int
+	// deviceDeliveries holds the messages each device received above its cursor
+	deviceDeliveries map[device]map[int]bool
+	// messageKeys maps the idempotency keys to the acknowledgments of their messages
+	messageKeys map[idempotencyKey]models.Acknowledgment
+	// outbox is ordered by ID
+	outbox []OutboxEntry
+
+	invites       []*models.Invite
+	refreshTokens map[string]*memoryRefreshToken
+	revokedTokens map[string]time.Time
+	auditLog      []models.AuditEntry
+
+	lastClientID  int
+	lastMessageID int
+	lastOutboxID  int
+	lastInviteID  int
+	lastAuditID   int
+}
+
+func newMemoryStore() *memoryStore {
+	store := &memoryStore{created: time.Now()}
+	store.reset()
+	return store
+}
+
+// reset empties the store, the caller must hold the mutex unless nobody else knows the store yet.
+func (store *memoryStore) reset() {
+	store.clients = make(map[int]*memoryClient)
+	store.usernames = make(map[string]int)
+	store.identities = make(map[identity]int)
+	store.chats = make(map[string]*memoryChat)
+	store.messages = nil
+	store.deliveries = make(map[int]map[int]bool)
+	store.deviceCursors = make(map[device]int)
+	store.deviceDeliveries = make(map[device]map[int]bool)
+	store.messageKeys = make(map[idempotencyKey]models.Acknowledgment)
+	store.outbox = nil
+	store.invites = nil
+	store.refreshTokens = make(map[string]*memoryRefreshToken)
+	store.revokedTokens = make(map[string]time.Time)
+	store.auditLog = nil
+	store.lastClientID, store.lastMessageID, store.lastOutboxID, store.lastInviteID, store.lastAuditID = 0, 0, 0, 0, 0
+}
+
+func (store *memoryStore) DropAllTables() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.reset()
+	return nil
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
+
+// MigrationStatus lists every migration as applied, the memory store always has the latest schema.
+func (store *memoryStore) MigrationStatus() ([]MigrationState, error) {
+	var states []MigrationState
+	for _, migration := range migrations {
+		states = append(states, MigrationState{Version: migration.version, Name: migration.name, AppliedAt: store.created})
+	}
+	return states, nil
+}
+
+func (store *memoryStore) MigrateUp() ([]int, error) {
+	return nil, nil
+}
+
+func (store *memoryStore) MigrateDown() (int, error) {
+	return 0, fmt.Errorf("the memory store has no schema to revert: %w", ErrNoMigration)
+}
+
+// addClient expects the caller to hold the mutex and to have checked that the username is free.
+func (store *memoryStore) addClient(username string, salt string, passwordHash string, role string) *memoryClient {
+	store.lastClientID++
+	client := &memoryClient{
+		client:       models.Client{ID: store.lastClientID, Username: username, Salt: salt},
+		role:         role,
+		passwordHash: passwordHash,
+	}
+	store.clients[client.client.ID] = client
+	store.usernames[username] = client.client.ID
+	return client
+}
+
+func (store *memoryStore) AddClient(username string, salt string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, taken := store.usernames[username]; taken {
+		return 0, fmt.Errorf("failed to add client: %w", ErrUsernameTaken)
+	}
+	return store.addClient(username, salt, "", models.RoleMember).client.ID, nil
+}
+
+func (store *memoryStore) ClientExists(clientID int) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	_, exists := store.clients[clientID]
+	return exists, nil
+}
+
+func (store *memoryStore) GetClientSalt(clientID int) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	client, ok := store.clients[clientID]
+	if !ok {
+		return "", fmt.Errorf("failed to get salt of client: %w", ErrClientNotFound)
+	}
+	return client.client.Salt, nil
+}
+
+func (store *memoryStore) GetClientUsername(clientID int) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	client, ok := store.clients[clientID]
+	if !ok {
+		return "", fmt.Errorf("failed to get username of client: %w", ErrClientNotFound)
+	}
+	return client.client.Username, nil
+}
+
+func (store *memoryStore) GetClientIDByUsername(username string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	clientID, ok := store.usernames[username]
+	if !ok {
+		return 0, fmt.Errorf("failed to get client by username: %w", ErrClientNotFound)
+	}
+	return clientID, nil
+}
+
+func (store *memoryStore) GetLoginState(username string) (*LoginState, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	clientID, ok := store.usernames[username]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	client := store.clients[clientID]
+	return &LoginState{
+		ClientID:     clientID,
+		PasswordHash: client.passwordHash,
+		Salt:         client.client.Salt,
+	}, nil
+}
+
+func (store *memoryStore) RecordLoginAttempt(clientID int, maxFailures int, lockout time.Duration) (time.Time, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	client, ok := store.clients[clientID]
+	if !ok {
+		return time.Time{}, fmt.Errorf("failed to record login attempt: %w", ErrClientNotFound)
+	}
+	now := time.Now()
+	if client.lockedUntil > now.Unix() {
+		return time.Time{}, ErrAccountLocked
+	}
+	client.failedLogins++
+	if client.failedLogins < maxFailures {
+		return time.Time{}, nil
+	}
+	client.failedLogins = 0
+	client.lockedUntil = now.Add(lockout).Unix()
+	return time.Unix(client.lockedUntil, 0), nil
+}
+
+func (store *memoryStore) ResetLoginFailures(clientID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if client, ok := store.clients[clientID]; ok {
+		client.failedLogins = 0
+		client.lockedUntil = 0
+	}
+	return nil
+}
+
+func (store *memoryStore) GetPasswordHash(clientID int) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	client, ok := store.clients[clientID]
+	if !ok {
+		return "", ErrClientNotFound
+	}
+	return client.passwordHash, nil
+}
+
+func (store *memoryStore) SetPassword(clientID int, hash string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if client, ok := store.clients[clientID]; ok {
+		client.passwordHash = hash
+		client.failedLogins = 0
+		client.lockedUntil = 0
+	}
+	for _, token := range store.refreshTokens {
+		if token.clientID == clientID {
+			token.revoked = true
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) ProvisionIdentityClient(issuer string, subject string, username string, salt string) (*models.Client, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := identity{issuer: issuer, subject: subject}
+	if clientID, ok := store.identities[key]; ok {
+		client := store.clients[clientID].client
+		return &client, nil
+	}
+
+	candidate := username
+	for suffix := 2; ; suffix++ {
+		if _, taken := store.usernames[candidate]; !taken {
+			break
+		}
+		candidate = username + strconv.Itoa(suffix)
+	}
+	client := store.addClient(candidate, salt, "", models.RoleMember).client
+	store.identities[key] = client.ID
+	return &client, nil
+}
+
+func (store *memoryStore) GetRoles(clientID int, chatID string) (models.Roles, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var roles models.Roles
+	client, ok := store.clients[clientID]
+	if !ok {
+		return roles, ErrClientNotFound
+	}
+	roles.Server = client.role
+	if chat, ok := store.chats[chatID]; ok {
+		roles.Chat = chat.members[clientID]
+	}
+	return roles, nil
+}
+
+func (store *memoryStore) SetServerRole(clientID int, role string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	client, ok := store.clients[clientID]
+	if !ok {
+		return ErrClientNotFound
+	}
+	client.role = role
+	return nil
+}
+
+func (store *memoryStore) CreateInvite(code string, createdBy int, maxUses int, expiresAt time.Time) (*models.Invite, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.findInvite(code) != nil {
+		return nil, fmt.Errorf("failed to create invite: code %q exists", code)
+	}
+	invite := models.Invite{Code: code, CreatedBy: createdBy, CreatedAt: time.Now().Unix(), MaxUses: maxUses}
+	if !expiresAt.IsZero() {
+		invite.ExpiresAt = expiresAt.Unix()
+	}
+	return store.addInvite(invite), nil
+}
+
+// addInvite assigns the invite its ID, the caller must hold the mutex.
+func (store *memoryStore) addInvite(invite models.Invite) *models.Invite {
+	store.lastInviteID++
+	invite.ID = store.lastInviteID
+	store.invites = append(store.invites, &invite)
+	result := invite
+	return &result
+}
+
+func (store *memoryStore) findInvite(code string) *models.Invite {
+	for _, invite := range store.invites {
+		if invite.Code == code {
+			return invite
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) SeedInvites(codes []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, code := range codes {
+		if store.findInvite(code) == nil {
+			store.addInvite(models.Invite{Code: code, CreatedAt: time.Now().Unix(), MaxUses: 1})
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) ListInvites() ([]models.Invite, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	invites := make([]models.Invite, 0, len(store.invites))
+	for _, invite := range store.invites {
+		invites = append(invites, *invite)
+	}
+	return invites, nil
+}
+
+func (store *memoryStore) RevokeInvite(inviteID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, invite := range store.invites {
+		if invite.ID == inviteID {
+			invite.Revoked = true
+			return nil
+		}
+	}
+	return ErrInviteNotFound
+}
+
+func (store *memoryStore) RegisterClientWithInvite(code string, username string, salt string, passwordHash string, role string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	invite := store.findInvite(code)
+	if invite == nil || invite.Revoked || invite.Uses >= invite.MaxUses ||
+		(invite.ExpiresAt != 0 && invite.ExpiresAt <= time.Now().Unix()) {
+		return 0, ErrInviteInvalid
+	}
+	if _, taken := store.usernames[username]; taken {
+		return 0, ErrUsernameTaken
+	}
+	invite.Uses++
+	return store.addClient(username, salt, passwordHash, role).client.ID, nil
+}
+
+func (store *memoryStore) StoreRefreshToken(clientID int, tokenHash string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exists := store.refreshTokens[tokenHash]; exists {
+		return fmt.Errorf("failed to store refresh token: token exists")
+	}
+	store.refreshTokens[tokenHash] = &memoryRefreshToken{clientID: clientID, expiresAt: expiresAt.Unix()}
+	return nil
+}
+
+func (store *memoryStore) RotateRefreshToken(oldHash string, newHash string, expiresAt time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	token, ok := store.refreshTokens[oldHash]
+	if !ok {
+		return 0, ErrRefreshTokenInvalid
+	}
+	if token.revoked {
+		for _, other := range store.refreshTokens {
+			if other.clientID == token.clientID {
+				other.revoked = true
+			}
+		}
+		return token.clientID, ErrRefreshTokenReused
+	}
+	if time.Now().Unix() >= token.expiresAt {
+		return 0, ErrRefreshTokenInvalid
+	}
+	token.revoked = true
+	store.refreshTokens[newHash] = &memoryRefreshToken{clientID: token.clientID, expiresAt: expiresAt.Unix()}
+	return token.clientID, nil
+}
+
+func (store *memoryStore) RevokeRefreshToken(clientID int, tokenHash string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	token, ok := store.refreshTokens[tokenHash]
+	if !ok || token.clientID != clientID {
+		return false, nil
+	}
+	token.revoked = true
+	return true, nil
+}
+
+func (store *memoryStore) RevokeAccessToken(clientID int, tokenID string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exists := store.revokedTokens[tokenID]; !exists {
+		store.revokedTokens[tokenID] = time.Unix(expiresAt.Unix(), 0)
+	}
+	return nil
+}
+
+func (store *memoryStore) LoadRevokedTokens() (map[string]time.Time, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now().Unix()
+	tokens := make(map[string]time.Time)
+	for tokenID, expiresAt := range store.revokedTokens {
+		if expiresAt.Unix() < now {
+			delete(store.revokedTokens, tokenID)
+			continue
+		}
+		tokens[tokenID] = expiresAt
+	}
+	return tokens, nil
+}
+
+func (store *memoryStore) RecordAudit(actorID int, action string, chatID string, target string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.lastAuditID++
+	store.auditLog = append(store.auditLog, models.AuditEntry{
+		ID:        store.lastAuditID,
+		ActorID:   actorID,
+		Action:    action,
+		ChatID:    chatID,
+		Target:    target,
+		CreatedAt: time.Now().Unix(),
+	})
+	return nil
+}
+
+func (store *memoryStore) ListAuditLog(beforeID int, limit int) ([]models.AuditEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entries := []models.AuditEntry{}
+	for i := len(store.auditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		if beforeID == 0 || store.auditLog[i].ID < beforeID {
+			entries = append(entries, store.auditLog[i])
+		}
+	}
+	return entries, nil
+}
+
+// addMember expects the caller to hold the mutex, members keep the role they already have.
+func (chat *memoryChat) addMember(clientID int, role string) {
+	if _, exists := chat.members[clientID]; !exists {
+		chat.members[clientID] = role
+	}
+}
+
+// chat returns the stored chat, the caller must hold the mutex.
+func (store *memoryStore) chat(chatID string) (*memoryChat, error) {
+	chat, ok := store.chats[chatID]
+	if !ok {
+		return nil, ErrChatNotFound
+	}
+	return chat, nil
+}
+
+// newChat expects the caller to hold the mutex and to have checked that the chat ID is free.
+func (store *memoryStore) newChat(clientID int, chatID string, name string, kind string) *memoryChat {
+	chat := &memoryChat{
+		chat:        models.Chat{ChatID: chatID, Name: name, Kind: kind, CreatedBy: clientID},
+		members:     make(map[int]string),
+		invitations: make(map[int]int),
+	}
+	store.chats[chatID] = chat
+	return chat
+}
+
+func (store *memoryStore) AddChat(clientID int, chatID string, kind string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.clients[clientID]; !ok {
+		return fmt.Errorf("failed to store chat: %w", ErrClientNotFound)
+	}
+	chat, ok := store.chats[chatID]
+	if !ok {
+		chat = store.newChat(clientID, chatID, "", kind)
+	}
+	chat.addMember(clientID, models.ChatRoleMember)
+	return nil
+}
+
+func (store *memoryStore) AddDirectChat(clientID int, recipientID int, chatID string) error {
+	if err := store.AddChat(clientID, chatID, models.ChatKindDirect); err != nil {
+		return err
+	}
+	return store.AddChatMember(chatID, recipientID)
+}
+
+func (store *memoryStore) CreateChat(clientID int, chatID string, name string, memberIDs []int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exists := store.chats[chatID]; exists {
+		return ErrChatExists
+	}
+	for _, memberID := range append([]int{clientID}, memberIDs...) {
+		if _, ok := store.clients[memberID]; !ok {
+			return fmt.Errorf("failed to add member %d to chat: %w", memberID, ErrClientNotFound)
+		}
+	}
+	chat := store.newChat(clientID, chatID, name, models.ChatKindGroup)
+	chat.addMember(clientID, models.ChatRoleOwner)
+	for _, memberID := range memberIDs {
+		chat.addMember(memberID, models.ChatRoleMember)
+	}
+	return nil
+}
+
+func (store *memoryStore) GetChat(chatID string) (*models.Chat, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	chat, err := store.chat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	result := chat.chat
+	return &result, nil
+}
+
+func (store *memoryStore) AddChatMember(chatID string, clientID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	chat, err := store.chat(chatID)
+	if err != nil {
+		return fmt.Errorf("failed to add chat member: %w", err)
+	}
+	if _, ok := store.clients[clientID]; !ok {
+		return fmt.Errorf("failed to add chat member: %w", ErrClientNotFound)
+	}
+	chat.addMember(clientID, models.ChatRoleMember)
+	return nil
+}
+
+func (store *memoryStore) RemoveChatMember(chatID string, clientID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if chat, ok := store.chats[chatID]; ok {
+		delete(chat.members, clientID)
+	}
+	return nil
+}
+
+// sortedMembers returns the chat's member IDs in ascending order, the caller must hold the mutex.
+func (chat *memoryChat) sortedMembers() []int {
+	clientIDs := make([]int, 0, len(chat.members))
+	for clientID := range chat.members {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Ints(clientIDs)
+	return clientIDs
+}
+
+func (store *memoryStore) GetChatMembers(chatID string) ([]int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	chat, ok := store.chats[chatID]
+	if !ok {
+		return nil, nil
+	}
+	return chat.sortedMembers(), nil
+}
+
+func (store *memoryStore) GetChatMemberDetails(chatID string) ([]models.ChatMember, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	members := []models.ChatMember{}
+	chat, ok := store.chats[chatID]
+	if !ok {
+		return members, nil
+	}
+	for _, clientID := range chat.sortedMembers() {
+		members = append(members, models.ChatMember{
+			ClientID: clientID,
+			Username: store.clients[clientID].client.Username,
+			Role:     chat.members[clientID],
+		})
+	}
+	return members, nil
+}
+
+func (store *memoryStore) SetChatRole(chatID string, clientID int, role string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	chat, ok := store.chats[chatID]
+	if !ok {
+		return ErrNotChatMember
+	}
+	if _, member := chat.members[clientID]; !member {
+		return ErrNotChatMember
+	}
+	chat.members[clientID] = role
+	return nil
+}
+
+func (store *memoryStore) InviteToChat(chatID string, clientID int, invitedBy int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	chat, err := store.chat(chatID)
+	if err != nil {
+		return fmt.Errorf("failed to store invitation: %w", err)
+	}
+	if _, exists := chat.invitations[clientID]; !exists {
+		chat.invitations[clientID] = invitedBy
+	}
+	return nil
+}
+
+func (store *memoryStore) AcceptInvitation(chatID string, clientID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	chat, ok := store.chats[chatID]
+	if !ok {
+		return ErrNotInvited
+	}
+	if _, invited := chat.invitations[clientID]; !invited {
+		return ErrNotInvited
+	}
+	delete(chat.invitations, clientID)
+	chat.addMember(clientID, models.ChatRoleMember)
+	return nil
+}
+
+func (store *memoryStore) StoreMessage(message models.Message, senderSession string) (*models.Acknowledgment, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := idempotencyKey{clientID: message.ClientID, key: message.IdempotencyKey}
+	if original, ok := store.messageKeys[key]; ok && key.key != "" {
+		return &original, ErrDuplicateMessage
+	}
+	chat, err := store.chat(message.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	store.lastMessageID++
+	chat.lastSeq++
+	store.messages = append(store.messages, models.DBMessage{
+		DBID:         store.lastMessageID,
+		ClientID:     message.ClientID,
+		ChatID:       message.ChatID,
+		Text:         message.Text,
+		Timestamp_ms: message.Timestamp_ms,
+		Hash:         message.Hash,
+		Seq:          chat.lastSeq,
+	})
+	// The sender gets a delivery too, already acknowledged, so that its other devices replay the message
+	recipients := make(map[int]bool)
+	for clientID := range chat.members {
+		recipients[clientID] = clientID == message.ClientID
+	}
+	store.deliveries[store.lastMessageID] = recipients
+	store.lastOutboxID++
+	store.outbox = append(store.outbox, OutboxEntry{
+		ID:            store.lastOutboxID,
+		Message:       store.messages[len(store.messages)-1],
+		SenderSession: senderSession,
+	})
+	ack := models.Acknowledgment{MessageID: store.lastMessageID, ChatID: message.ChatID, Timestamp_ms: time.Now().UnixMilli(), Seq: chat.lastSeq}
+	if key.key != "" {
+		store.messageKeys[key] = ack
+	}
+	return &ack, nil
+}
+
+func (store *memoryStore) GetMessageByKey(clientID int, key string) (*models.Acknowledgment, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	ack, ok := store.messageKeys[idempotencyKey{clientID: clientID, key: key}]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	return &ack, nil
+}
+
+// findMessage returns the index of the message in store.messages, the caller must hold the mutex.
+func (store *memoryStore) findMessage(messageID int) (int, bool) {
+	index := sort.Search(len(store.messages), func(i int) bool { return store.messages[i].DBID >= messageID })
+	return index, index < len(store.messages) && store.messages[index].DBID == messageID
+}
+
+func (store *memoryStore) RetrieveUndeliveredMessages(clientID int, deviceID string, afterID int) ([]models.DBMessage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	received := store.deviceDeliveries[device{clientID: clientID, deviceID: deviceID}]
+	var messages []models.DBMessage
+	for _, message := range store.messages {
+		if _, addressed := store.deliveries[message.DBID][clientID]; addressed && message.DBID > afterID && !received[message.DBID] {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (store *memoryStore) RetrieveMessageHistory(query models.HistoryQuery) (*models.HistoryPage, error) {
+	query.Normalize()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	matches := func(message models.DBMessage) bool {
+		return message.ChatID == query.ChatID &&
+			(query.Before == 0 || message.DBID < query.Before) &&
+			(query.After == 0 || message.DBID > query.After) &&
+			(query.BeforeSeq == 0 || message.Seq < query.BeforeSeq) &&
+			(query.AfterSeq == 0 || message.Seq > query.AfterSeq) &&
+			(query.BeforeMs == 0 || message.Timestamp_ms < query.BeforeMs) &&
+			(query.AfterMs == 0 || message.Timestamp_ms > query.AfterMs)
+	}
+
+	page := &models.HistoryPage{ChatID: query.ChatID, Messages: []models.Message{}}
+	if chat, ok := store.chats[query.ChatID]; ok {
+		page.LastSeq = chat.lastSeq
+	}
+	collect := func(message models.DBMessage) bool {
+		if matches(message) {
+			page.Messages = append(page.Messages, message.Message())
+		}
+		// One more message than requested tells whether there is another page
+		return len(page.Messages) <= query.Limit
+	}
+	if query.Forward() {
+		for i := 0; i < len(store.messages) && collect(store.messages[i]); i++ {
+		}
+	} else {
+		for i := len(store.messages) - 1; i >= 0 && collect(store.messages[i]); i-- {
+		}
+	}
+	return finishPage(page, query), nil
+}
+
+func (store *memoryStore) GetMessageAuthor(messageID int) (string, int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	index, ok := store.findMessage(messageID)
+	if !ok {
+		return "", 0, ErrMessageNotFound
+	}
+	return store.messages[index].ChatID, store.messages[index].ClientID, nil
+}
+
+func (store *memoryStore) DeleteMessage(messageID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	index, ok := store.findMessage(messageID)
+	if !ok {
+		return ErrMessageNotFound
+	}
+	store.messages = append(store.messages[:index], store.messages[index+1:]...)
+	delete(store.deliveries, messageID)
+	for _, received := range store.deviceDeliveries {
+		delete(received, messageID)
+	}
+	for key, ack := range store.messageKeys {
+		if ack.MessageID == messageID {
+			delete(store.messageKeys, key)
+		}
+	}
+	store.removeOutboxEntries(func(entry OutboxEntry) bool { return entry.Message.DBID == messageID })
+	return nil
+}
+
+// removeOutboxEntries drops the entries the predicate matches, the caller must hold the mutex.
+func (store *memoryStore) removeOutboxEntries(matches func(OutboxEntry) bool) {
+	kept := store.outbox[:0]
+	for _, entry := range store.outbox {
+		if !matches(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	store.outbox = kept
+}
+
+func (store *memoryStore) PendingOutbox(limit int) ([]OutboxEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if len(store.outbox) < limit {
+		limit = len(store.outbox)
+	}
+	return append([]OutboxEntry(nil), store.outbox[:limit]...), nil
+}
+
+func (store *memoryStore) CompleteOutboxEntry(entryID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.removeOutboxEntries(func(entry OutboxEntry) bool { return entry.ID == entryID })
+	return nil
+}
+
+func (store *memoryStore) GetDeviceCursor(clientID int, deviceID string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := device{clientID: clientID, deviceID: deviceID}
+	if deliveredUpTo, ok := store.deviceCursors[key]; ok {
+		return deliveredUpTo, nil
+	}
+	// Like the SQL stores, a new device starts before the oldest unacknowledged message
+	oldestUndelivered, newest := 0, 0
+	for messageID, recipients := range store.deliveries {
+		delivered, addressed := recipients[clientID]
+		if !addressed {
+			continue
+		}
+		if !delivered && (oldestUndelivered == 0 || messageID < oldestUndelivered) {
+			oldestUndelivered = messageID
+		}
+		if messageID > newest {
+			newest = messageID
+		}
+	}
+	deliveredUpTo := newest
+	if oldestUndelivered != 0 {
+		deliveredUpTo = oldestUndelivered - 1
+	}
+	store.deviceCursors[key] = deliveredUpTo
+	return deliveredUpTo, nil
+}
+
+func (store *memoryStore) AdvanceDeviceCursor(clientID int, deviceID string, messageID int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := device{clientID: clientID, deviceID: deviceID}
+	deliveredUpTo, ok := store.deviceCursors[key]
+	if _, addressed := store.deliveries[messageID][clientID]; !addressed || (ok && messageID <= deliveredUpTo) {
+		return nil
+	}
+	received := store.deviceDeliveries[key]
+	if received == nil {
+		received = make(map[int]bool)
+		store.deviceDeliveries[key] = received
+	}
+	received[messageID] = true
+	// Like the SQL stores, a device without a cursor keeps the delivery for when its cursor is created
+	if !ok {
+		return nil
+	}
+	// Like the SQL stores, the cursor passes received messages up to the first gap
+	for _, message := range store.messages {
+		if _, addressed := store.deliveries[message.DBID][clientID]; !addressed || message.DBID <= deliveredUpTo {
+			continue
+		}
+		if !received[message.DBID] {
+			break
+		}
+		deliveredUpTo = message.DBID
+		delete(received, message.DBID)
+	}
+	store.deviceCursors[key] = deliveredUpTo
+	return nil
+}
+
+func (store *memoryStore) MarkMessageDelivered(messageID int, clientID int) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delivered, addressed := store.deliveries[messageID][clientID]
+	if !addressed || delivered {
+		return false, nil
+	}
+	store.deliveries[messageID][clientID] = true
+	return true, nil
+}
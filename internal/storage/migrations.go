@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSchemaBehind = errors.New("database schema is behind, run the migrate up command")
+	ErrSchemaAhead  = errors.New("database schema is newer than this server")
+	ErrNoMigration  = errors.New("no migration to revert")
+)
+
+// migration changes the schema from version-1 to version. Every statement runs on its own, {{serial}}
+// stands for the dialect's auto-incrementing primary key. sqliteUp and sqliteDown replace up and down
+// on SQLite where its ALTER TABLE falls short.
+type migration struct {
+	version    int
+	name       string
+	up         []string
+	down       []string
+	sqliteUp   []string
+	sqliteDown []string
+}
+
+// statements returns the migration's up or down statements for the dialect.
+func (migration migration) statements(dialect dialect, up bool) []string {
+	if dialect.driver == sqliteDialect.driver {
+		if up && migration.sqliteUp != nil {
+			return migration.sqliteUp
+		}
+		if !up && migration.sqliteDown != nil {
+			return migration.sqliteDown
+		}
+	}
+	if up {
+		return migration.up
+	}
+	return migration.down
+}
+
+const identitiesTable = `CREATE TABLE identities (
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+	PRIMARY KEY (issuer, subject)
+);`
+
+// migrations are ordered by version and never change once released, a schema change is a new migration.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// The schema the server created before there were migrations, those databases already have it
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS clients (
+				id {{serial}},
+				username TEXT UNIQUE NOT NULL,
+				token TEXT UNIQUE NOT NULL,
+				salt TEXT UNIQUE NOT NULL
+			);`,
+			`CREATE TABLE IF NOT EXISTS chats (
+				id {{serial}},
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				chat_id TEXT UNIQUE NOT NULL
+			);`,
+			`CREATE TABLE IF NOT EXISTS messages (
+				id {{serial}},
+				chat_id TEXT REFERENCES chats(chat_id) ON DELETE CASCADE,
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				text TEXT,
+				timestamp_ms BIGINT,
+				hash TEXT,
+				delivered BOOLEAN DEFAULT FALSE
+			);`,
+			`CREATE TABLE IF NOT EXISTS secrets (
+				id {{serial}},
+				secret TEXT UNIQUE NOT NULL,
+				used BOOLEAN DEFAULT FALSE
+			);`,
+		},
+		down: []string{
+			"DROP TABLE secrets;",
+			"DROP TABLE messages;",
+			"DROP TABLE chats;",
+			"DROP TABLE clients;",
+		},
+	},
+	{
+		version: 2,
+		name:    "client roles and passwords",
+		up: []string{
+			// Clients authenticate with signed tokens, the stored token is no longer used
+			"ALTER TABLE clients DROP COLUMN token;",
+			"ALTER TABLE clients ADD COLUMN role TEXT NOT NULL DEFAULT 'member';",
+			"ALTER TABLE clients ADD COLUMN password_hash TEXT;",
+			"ALTER TABLE clients ADD COLUMN failed_logins INT NOT NULL DEFAULT 0;",
+			"ALTER TABLE clients ADD COLUMN locked_until BIGINT NOT NULL DEFAULT 0;",
+			identitiesTable,
+		},
+		down: []string{
+			"DROP TABLE identities;",
+			"ALTER TABLE clients DROP COLUMN locked_until;",
+			"ALTER TABLE clients DROP COLUMN failed_logins;",
+			"ALTER TABLE clients DROP COLUMN password_hash;",
+			"ALTER TABLE clients DROP COLUMN role;",
+			// The salt is unique too, so it stands in for the tokens that are gone
+			"ALTER TABLE clients ADD COLUMN token TEXT;",
+			"UPDATE clients SET token = salt;",
+			"ALTER TABLE clients ALTER COLUMN token SET NOT NULL;",
+			"ALTER TABLE clients ADD CONSTRAINT clients_token_key UNIQUE (token);",
+		},
+		// SQLite cannot drop a UNIQUE column, it copies the table instead
+		sqliteUp: []string{
+			`CREATE TABLE clients_new (
+				id {{serial}},
+				username TEXT UNIQUE NOT NULL,
+				salt TEXT UNIQUE NOT NULL,
+				role TEXT NOT NULL DEFAULT 'member',
+				password_hash TEXT,
+				failed_logins INT NOT NULL DEFAULT 0,
+				locked_until BIGINT NOT NULL DEFAULT 0
+			);`,
+			"INSERT INTO clients_new (id, username, salt) SELECT id, username, salt FROM clients;",
+			"DROP TABLE clients;",
+			"ALTER TABLE clients_new RENAME TO clients;",
+			identitiesTable,
+		},
+		sqliteDown: []string{
+			"DROP TABLE identities;",
+			`CREATE TABLE clients_old (
+				id {{serial}},
+				username TEXT UNIQUE NOT NULL,
+				token TEXT UNIQUE NOT NULL,
+				salt TEXT UNIQUE NOT NULL
+			);`,
+			"INSERT INTO clients_old (id, username, token, salt) SELECT id, username, salt, salt FROM clients;",
+			"DROP TABLE clients;",
+			"ALTER TABLE clients_old RENAME TO clients;",
+		},
+	},
+	{
+		version: 3,
+		name:    "chat members and invitations",
+		up: []string{
+			"ALTER TABLE chats ADD COLUMN name TEXT NOT NULL DEFAULT '';",
+			"ALTER TABLE chats ADD COLUMN kind TEXT NOT NULL DEFAULT 'group';",
+			`CREATE TABLE chat_members (
+				chat_id TEXT REFERENCES chats(chat_id) ON DELETE CASCADE,
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				role TEXT NOT NULL DEFAULT 'member',
+				PRIMARY KEY (chat_id, client_id)
+			);`,
+			`CREATE TABLE chat_invitations (
+				chat_id TEXT REFERENCES chats(chat_id) ON DELETE CASCADE,
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				invited_by INT REFERENCES clients(id) ON DELETE CASCADE,
+				PRIMARY KEY (chat_id, client_id)
+			);`,
+			// Chats had no members, whoever created a chat owns it and whoever wrote in it is a member
+			`INSERT INTO chat_members (chat_id, client_id, role)
+			SELECT chat_id, client_id, 'owner' FROM chats WHERE client_id IS NOT NULL;`,
+			`INSERT INTO chat_members (chat_id, client_id, role)
+			SELECT DISTINCT chat_id, client_id, 'member' FROM messages
+			WHERE chat_id IS NOT NULL AND client_id IS NOT NULL AND NOT EXISTS (
+				SELECT 1 FROM chat_members
+				WHERE chat_members.chat_id = messages.chat_id AND chat_members.client_id = messages.client_id);`,
+		},
+		down: []string{
+			"DROP TABLE chat_invitations;",
+			"DROP TABLE chat_members;",
+			"ALTER TABLE chats DROP COLUMN kind;",
+			"ALTER TABLE chats DROP COLUMN name;",
+		},
+	},
+	{
+		version: 4,
+		name:    "message deliveries",
+		up: []string{
+			// Whether a message was delivered depends on the recipient and the device now
+			"ALTER TABLE messages DROP COLUMN delivered;",
+			`CREATE TABLE message_deliveries (
+				message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				delivered BOOLEAN DEFAULT FALSE,
+				PRIMARY KEY (message_id, client_id)
+			);`,
+			`CREATE TABLE device_cursors (
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				device_id TEXT NOT NULL,
+				delivered_up_to INT NOT NULL DEFAULT 0,
+				PRIMARY KEY (client_id, device_id)
+			);`,
+		},
+		down: []string{
+			"DROP TABLE device_cursors;",
+			"DROP TABLE message_deliveries;",
+			"ALTER TABLE messages ADD COLUMN delivered BOOLEAN DEFAULT FALSE;",
+		},
+	},
+	{
+		version: 5,
+		name:    "refresh tokens and audit log",
+		up: []string{
+			`CREATE TABLE refresh_tokens (
+				token_hash TEXT PRIMARY KEY,
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				expires_at BIGINT NOT NULL,
+				revoked BOOLEAN DEFAULT FALSE
+			);`,
+			`CREATE TABLE revoked_tokens (
+				token_id TEXT PRIMARY KEY,
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				expires_at BIGINT NOT NULL
+			);`,
+			`CREATE TABLE audit_log (
+				id {{serial}},
+				actor_id INT REFERENCES clients(id) ON DELETE SET NULL,
+				action TEXT NOT NULL,
+				chat_id TEXT NOT NULL DEFAULT '',
+				target TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL
+			);`,
+		},
+		down: []string{
+			"DROP TABLE audit_log;",
+			"DROP TABLE revoked_tokens;",
+			"DROP TABLE refresh_tokens;",
+		},
+	},
+	{
+		version: 6,
+		name:    "invite codes",
+		up: []string{
+			"ALTER TABLE secrets ADD COLUMN created_by INT REFERENCES clients(id) ON DELETE SET NULL;",
+			"ALTER TABLE secrets ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0;",
+			"ALTER TABLE secrets ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;",
+			"ALTER TABLE secrets ADD COLUMN max_uses INT NOT NULL DEFAULT 1;",
+			"ALTER TABLE secrets ADD COLUMN uses INT NOT NULL DEFAULT 0;",
+			"ALTER TABLE secrets ADD COLUMN revoked BOOLEAN DEFAULT FALSE;",
+			// The secrets stored so far are the ones that were used
+			"UPDATE secrets SET uses = max_uses WHERE used = TRUE;",
+			"ALTER TABLE secrets DROP COLUMN used;",
+		},
+		down: []string{
+			"ALTER TABLE secrets ADD COLUMN used BOOLEAN DEFAULT FALSE;",
+			"UPDATE secrets SET used = (uses >= max_uses);",
+			"ALTER TABLE secrets DROP COLUMN revoked;",
+			"ALTER TABLE secrets DROP COLUMN uses;",
+			"ALTER TABLE secrets DROP COLUMN max_uses;",
+			"ALTER TABLE secrets DROP COLUMN expires_at;",
+			"ALTER TABLE secrets DROP COLUMN created_at;",
+			"ALTER TABLE secrets DROP COLUMN created_by;",
+		},
+		// SQLite cannot drop a column with a foreign key, it copies the table instead
+		sqliteDown: []string{
+			`CREATE TABLE secrets_old (
+				id {{serial}},
+				secret TEXT UNIQUE NOT NULL,
+				used BOOLEAN DEFAULT FALSE
+			);`,
+			"INSERT INTO secrets_old (id, secret, used) SELECT id, secret, uses >= max_uses FROM secrets;",
+			"DROP TABLE secrets;",
+			"ALTER TABLE secrets_old RENAME TO secrets;",
+		},
+	},
+	{
+		version: 7,
+		name:    "message outbox",
+		up: []string{
+			`CREATE TABLE outbox (
+				id {{serial}},
+				message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				sender_session TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL
+			);`,
+		},
+		down: []string{
+			"DROP TABLE outbox;",
+		},
+	},
+	{
+		version: 8,
+		name:    "message idempotency keys",
+		up: []string{
+			"ALTER TABLE messages ADD COLUMN idempotency_key TEXT;",
+			"ALTER TABLE messages ADD COLUMN stored_at_ms BIGINT NOT NULL DEFAULT 0;",
+			// Messages without a key have a NULL key, which never conflicts
+			"CREATE UNIQUE INDEX messages_idempotency_key ON messages (client_id, idempotency_key);",
+		},
+		down: []string{
+			"DROP INDEX messages_idempotency_key;",
+			"ALTER TABLE messages DROP COLUMN stored_at_ms;",
+			"ALTER TABLE messages DROP COLUMN idempotency_key;",
+		},
+	},
+	{
+		version: 9,
+		name:    "per-chat sequence numbers",
+		up: []string{
+			"ALTER TABLE chats ADD COLUMN last_seq INT NOT NULL DEFAULT 0;",
+			"ALTER TABLE messages ADD COLUMN seq INT NOT NULL DEFAULT 0;",
+			// Existing messages are numbered in the order they were stored
+			`UPDATE messages SET seq = (
+				SELECT COUNT(*) FROM messages AS earlier
+				WHERE earlier.chat_id = messages.chat_id AND earlier.id <= messages.id
+			);`,
+			`UPDATE chats SET last_seq = (
+				SELECT COALESCE(MAX(seq), 0) FROM messages WHERE messages.chat_id = chats.chat_id
+			);`,
+			"CREATE UNIQUE INDEX messages_chat_seq ON messages (chat_id, seq);",
+		},
+		down: []string{
+			"DROP INDEX messages_chat_seq;",
+			"ALTER TABLE messages DROP COLUMN seq;",
+			"ALTER TABLE chats DROP COLUMN last_seq;",
+		},
+	},
+	{
+		version: 10,
+		name:    "per-device deliveries",
+		up: []string{
+			// The messages a device received above its cursor, the cursor only passes messages without a gap
+			`CREATE TABLE device_deliveries (
+				client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+				device_id TEXT NOT NULL,
+				message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+				PRIMARY KEY (client_id, device_id, message_id)
+			);`,
+		},
+		down: []string{
+			// Senders have deliveries of their own messages from this version on
+			`DELETE FROM message_deliveries WHERE client_id = (
+				SELECT client_id FROM messages WHERE messages.id = message_deliveries.message_id
+			);`,
+			"DROP TABLE device_deliveries;",
+		},
+	},
+}
+
+// LatestSchemaVersion is the version the server's queries are written against.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationState tells whether a migration has been applied. Migrations the database knows but this
+// server does not are listed with the name "unknown".
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+func (state MigrationState) Applied() bool {
+	return !state.AppliedAt.IsZero()
+}
+
+// CheckSchema returns ErrSchemaBehind or ErrSchemaAhead unless the store's schema is at the latest version.
+func CheckSchema(migrator Migrator) error {
+	states, err := migrator.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if !state.Applied() {
+			return fmt.Errorf("%w: migration %d (%s) is pending", ErrSchemaBehind, state.Version, state.Name)
+		}
+		if state.Version > LatestSchemaVersion() {
+			return fmt.Errorf("%w: it has migration %d", ErrSchemaAhead, state.Version)
+		}
+	}
+	return nil
+}
+
+func (db *sqlStore) createMigrationsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	);`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// appliedMigrations maps the version of every applied migration to the time it was applied.
+func (db *sqlStore) appliedMigrations() (map[int]MigrationState, error) {
+	if err := db.createMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]MigrationState)
+	for rows.Next() {
+		var state MigrationState
+		var appliedAt int64
+		if err := rows.Scan(&state.Version, &state.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		state.AppliedAt = time.Unix(appliedAt, 0)
+		applied[state.Version] = state
+	}
+	return applied, rows.Err()
+}
+
+func (db *sqlStore) MigrationStatus() ([]MigrationState, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	for _, migration := range migrations {
+		state := MigrationState{Version: migration.version, Name: migration.name}
+		if appliedState, ok := applied[migration.version]; ok {
+			state.AppliedAt = appliedState.AppliedAt
+		}
+		states = append(states, state)
+	}
+	for version, state := range applied {
+		if version > LatestSchemaVersion() {
+			states = append(states, MigrationState{Version: version, Name: "unknown", AppliedAt: state.AppliedAt})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// MigrateUp applies all pending migrations in order and returns the versions it applied.
+func (db *sqlStore) MigrateUp() ([]int, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, migration := range migrations {
+		if _, ok := applied[migration.version]; ok {
+			continue
+		}
+		err := db.runMigration(migration.statements(db.dialect, true), func(transaction *sql.Tx) error {
+			_, err := transaction.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+				migration.version, migration.name, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return versions, fmt.Errorf("migration %d (%s) failed: %w", migration.version, migration.name, err)
+		}
+		versions = append(versions, migration.version)
+	}
+	return versions, nil
+}
+
+// MigrateDown reverts the newest applied migration and returns its version.
+func (db *sqlStore) MigrateDown() (int, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.version]; !ok {
+			continue
+		}
+		err := db.runMigration(migration.statements(db.dialect, false), func(transaction *sql.Tx) error {
+			_, err := transaction.Exec("DELETE FROM schema_migrations WHERE version = $1", migration.version)
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("reverting migration %d (%s) failed: %w", migration.version, migration.name, err)
+		}
+		return migration.version, nil
+	}
+	return 0, ErrNoMigration
+}
+
+// runMigration runs the statements and the bookkeeping in one transaction, both SQL databases
+// roll back schema changes together with the data. Foreign keys are suspended for the dialects that
+// copy tables, the references are checked before the transaction commits.
+func (db *sqlStore) runMigration(statements []string, record func(*sql.Tx) error) error {
+	ctx := context.Background()
+	// The pragmas apply to a connection and outside of transactions, so everything runs on one
+	connection, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer connection.Close()
+	if db.dialect.suspendForeignKeys != "" {
+		if _, err := connection.ExecContext(ctx, db.dialect.suspendForeignKeys); err != nil {
+			return fmt.Errorf("failed to suspend foreign keys: %w", err)
+		}
+		defer connection.ExecContext(ctx, db.dialect.resumeForeignKeys)
+	}
+
+	transaction, err := connection.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	for _, statement := range statements {
+		if _, err := transaction.Exec(strings.ReplaceAll(statement, "{{serial}}", db.dialect.serialKey)); err != nil {
+			return err
+		}
+	}
+	if db.dialect.foreignKeyCheck != "" {
+		if err := checkForeignKeys(transaction, db.dialect.foreignKeyCheck); err != nil {
+			return err
+		}
+	}
+	if err := record(transaction); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+	return transaction.Commit()
+}
+
+// checkForeignKeys fails if the query lists a row whose reference is broken.
+func checkForeignKeys(transaction *sql.Tx, query string) error {
+	rows, err := transaction.Query(query)
+	if err != nil {
+		return fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return errors.New("migration breaks foreign key references")
+	}
+	return rows.Err()
+}
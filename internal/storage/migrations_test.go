@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/pkg/config"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// appliedVersions returns the versions MigrationStatus lists as applied.
+func appliedVersions(store Store, t *testing.T) []int {
+	states, err := store.MigrationStatus()
+	if err != nil {
+		t.Fatalf("failed to read migration status: %v", err)
+	}
+	if len(states) != LatestSchemaVersion() {
+		t.Fatalf("expected %d migrations, got %+v", LatestSchemaVersion(), states)
+	}
+	versions := []int{}
+	for _, state := range states {
+		if state.Applied() {
+			versions = append(versions, state.Version)
+		}
+	}
+	return versions
+}
+
+func allVersions() []int {
+	var versions []int
+	for _, migration := range migrations {
+		versions = append(versions, migration.version)
+	}
+	return versions
+}
+
+func TestMigrateDownAndUpAgain(t *testing.T) {
+	store := openSQLite(t)
+	if versions := appliedVersions(store, t); !reflect.DeepEqual(versions, allVersions()) {
+		t.Fatalf("expected every migration to be applied, got %v", versions)
+	}
+	if err := CheckSchema(store); err != nil {
+		t.Fatalf("expected the schema to be current, got %v", err)
+	}
+
+	// The down migrations have to cope with data, not only with empty tables
+	sender := addClient(store, "sender", t)
+	recipient := addClient(store, "recipient", t)
+	if err := store.CreateChat(sender, "chat", "Chat", []int{recipient}); err != nil {
+		t.Fatalf("failed to create chat: %v", err)
+	}
+	acks := storeMessages(store, sender, "chat", []string{"a", "b"}, t)
+	if err := store.AdvanceDeviceCursor(recipient, "phone", acks[1].MessageID); err != nil {
+		t.Fatalf("failed to advance cursor: %v", err)
+	}
+
+	for expected := LatestSchemaVersion(); expected > 0; expected-- {
+		version, err := store.MigrateDown()
+		if err != nil || version != expected {
+			t.Fatalf("expected to revert migration %d, got %d, %v", expected, version, err)
+		}
+		if versions := appliedVersions(store, t); !reflect.DeepEqual(versions, allVersions()[:expected-1]) {
+			t.Fatalf("expected migrations %v after reverting %d, got %v", allVersions()[:expected-1], expected, versions)
+		}
+	}
+	if _, err := store.MigrateDown(); !errors.Is(err, ErrNoMigration) {
+		t.Fatalf("expected ErrNoMigration, got %v", err)
+	}
+	if err := CheckSchema(store); !errors.Is(err, ErrSchemaBehind) {
+		t.Fatalf("expected ErrSchemaBehind, got %v", err)
+	}
+
+	versions, err := store.MigrateUp()
+	if err != nil || !reflect.DeepEqual(versions, allVersions()) {
+		t.Fatalf("expected every migration to be applied again, got %v, %v", versions, err)
+	}
+	if versions := appliedVersions(store, t); !reflect.DeepEqual(versions, allVersions()) {
+		t.Fatalf("expected every migration to be applied, got %v", versions)
+	}
+	if versions, err := store.MigrateUp(); err != nil || len(versions) != 0 {
+		t.Fatalf("expected nothing left to apply, got %v, %v", versions, err)
+	}
+
+	// The schema works again
+	sender = addClient(store, "sender", t)
+	if err := store.CreateChat(sender, "chat", "Chat", nil); err != nil {
+		t.Fatalf("failed to create chat after migrating up: %v", err)
+	}
+	storeMessages(store, sender, "chat", []string{"c"}, t)
+}
+
+// baselineSchema is what the server created before there were migrations, written for SQLite.
+var baselineSchema = []string{
+	`CREATE TABLE clients (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		token TEXT UNIQUE NOT NULL,
+		salt TEXT UNIQUE NOT NULL
+	);`,
+	`CREATE TABLE chats (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+		chat_id TEXT UNIQUE NOT NULL
+	);`,
+	`CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		chat_id TEXT REFERENCES chats(chat_id) ON DELETE CASCADE,
+		client_id INT REFERENCES clients(id) ON DELETE CASCADE,
+		text TEXT,
+		timestamp_ms BIGINT,
+		hash TEXT,
+		delivered BOOLEAN DEFAULT FALSE
+	);`,
+	`CREATE TABLE secrets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		secret TEXT UNIQUE NOT NULL,
+		used BOOLEAN DEFAULT FALSE
+	);`,
+	"INSERT INTO clients (username, token, salt) VALUES ('creator', 'creator-token', 'creator-salt'), ('writer', 'writer-token', 'writer-salt');",
+	"INSERT INTO chats (client_id, chat_id) VALUES (1, 'old-chat');",
+	"INSERT INTO messages (chat_id, client_id, text, timestamp_ms, hash) VALUES ('old-chat', 1, 'first', 1000, 'h1'), ('old-chat', 2, 'second', 2000, 'h2');",
+	"INSERT INTO secrets (secret, used) VALUES ('used-secret', TRUE);",
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.db")
+	baseline, err := sql.Open(sqliteDialect.driver, "file:"+path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for _, statement := range baselineSchema {
+		if _, err := baseline.Exec(statement); err != nil {
+			t.Fatalf("failed to create baseline schema: %v", err)
+		}
+	}
+	baseline.Close()
+
+	store, err := ConnectToDatabase(&config.DatabaseConfig{Driver: config.DriverSQLite, Path: path})
+	if err != nil {
+		t.Fatalf("failed to open SQLite store: %v", err)
+	}
+	defer store.Close()
+	if err := CheckSchema(store); !errors.Is(err, ErrSchemaBehind) {
+		t.Fatalf("expected ErrSchemaBehind before migrating, got %v", err)
+	}
+	if versions, err := store.MigrateUp(); err != nil || !reflect.DeepEqual(versions, allVersions()) {
+		t.Fatalf("expected every migration to be applied, got %v, %v", versions, err)
+	}
+	if err := CheckSchema(store); err != nil {
+		t.Fatalf("expected the schema to be current, got %v", err)
+	}
+	var foreignKeys int
+	if err := store.(*sqlStore).QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil || foreignKeys != 1 {
+		t.Fatalf("expected foreign keys to be enforced after migrating, got %d, %v", foreignKeys, err)
+	}
+
+	// The existing data survives and works with the current queries
+	creator, err := store.GetClientIDByUsername("creator")
+	if err != nil || creator != 1 {
+		t.Fatalf("expected the existing client, got %d, %v", creator, err)
+	}
+	members, err := store.GetChatMembers("old-chat")
+	sort.Ints(members)
+	if err != nil || !reflect.DeepEqual(members, []int{1, 2}) {
+		t.Fatalf("expected the creator and the writer to be members, got %v, %v", members, err)
+	}
+	if roles, err := store.GetRoles(creator, "old-chat"); err != nil || roles.Chat != "owner" {
+		t.Fatalf("expected the creator to own the chat, got %+v, %v", roles, err)
+	}
+	page, err := store.RetrieveMessageHistory(models.HistoryQuery{ChatID: "old-chat"})
+	if err != nil || len(page.Messages) != 2 || page.Messages[0].Seq != 1 || page.LastSeq != 2 {
+		t.Fatalf("expected the numbered messages, got %+v, %v", page, err)
+	}
+	if _, err := store.RegisterClientWithInvite("used-secret", "newcomer", "newcomer-salt", "", "member"); !errors.Is(err, ErrInviteInvalid) {
+		t.Fatalf("expected the used secret to stay used, got %v", err)
+	}
+	newcomer := addClient(store, "newcomer", t)
+	if newcomer <= 2 {
+		t.Fatalf("expected a new client ID, got %d", newcomer)
+	}
+	if err := store.AddChatMember("old-chat", newcomer); err != nil {
+		t.Fatalf("failed to add member: %v", err)
+	}
+	if ack, err := store.StoreMessage(models.Message{ClientID: newcomer, ChatID: "old-chat", Text: "third"}, "session"); err != nil || ack.Seq != 3 {
+		t.Fatalf("expected the next sequence number, got %+v, %v", ack, err)
+	}
+}
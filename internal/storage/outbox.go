@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+)
+
+// OutboxEntry is a stored message whose fan-out to the online sessions of its chat has not finished.
+type OutboxEntry struct {
+	ID            int
+	Message       models.DBMessage
+	SenderSession string
+}
+
+func (db *sqlStore) PendingOutbox(limit int) ([]OutboxEntry, error) {
+	query := `
+	SELECT outbox.id, outbox.sender_session, messages.id, messages.client_id, messages.chat_id, messages.text, messages.timestamp_ms, messages.hash, messages.seq
+	FROM outbox
+	JOIN messages ON messages.id = outbox.message_id
+	ORDER BY outbox.id
+	LIMIT $1;`
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		var entry OutboxEntry
+		message := &entry.Message
+		err := rows.Scan(&entry.ID, &entry.SenderSession, &message.DBID, &message.ClientID, &message.ChatID, &message.Text, &message.Timestamp_ms, &message.Hash, &message.Seq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbox entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CompleteOutboxEntry removes the entry once its message reached every online session.
+func (db *sqlStore) CompleteOutboxEntry(entryID int) error {
+	if _, err := db.Exec("DELETE FROM outbox WHERE id = $1", entryID); err != nil {
+		return fmt.Errorf("failed to complete outbox entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrClientNotFound = errors.New("client not found")
+	ErrAccountLocked  = errors.New("account locked")
+)
+
+// LoginState is what a login attempt needs to know about a client.
+type LoginState struct {
+	ClientID     int
+	PasswordHash string
+	Salt         string
+}
+
+func (db *sqlStore) GetLoginState(username string) (*LoginState, error) {
+	var state LoginState
+	query := `
+	SELECT id, COALESCE(password_hash, ''), salt
+	FROM clients
+	WHERE username = $1;`
+	err := db.QueryRow(query, username).Scan(&state.ClientID, &state.PasswordHash, &state.Salt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login state: %w", err)
+	}
+	return &state, nil
+}
+
+// RecordLoginAttempt counts a login attempt as failed before its password is checked, so parallel
+// attempts cannot get past the lockout. A locked account returns ErrAccountLocked. The attempt that
+// reaches maxFailures locks the account until the returned time and starts the count over,
+// otherwise the returned time is zero.
+func (db *sqlStore) RecordLoginAttempt(clientID int, maxFailures int, lockout time.Duration) (time.Time, error) {
+	// The check and the count are one statement, the row lock orders parallel attempts
+	query := `
+	UPDATE clients SET
+		failed_logins = CASE WHEN failed_logins + 1 >= $2 THEN 0 ELSE failed_logins + 1 END,
+		locked_until = CASE WHEN failed_logins + 1 >= $2 THEN $3 ELSE locked_until END
+	WHERE id = $1 AND locked_until <= $4
+	RETURNING locked_until;`
+	now := time.Now()
+	var lockedUntil int64
+	err := db.QueryRow(query, clientID, maxFailures, now.Add(lockout).Unix(), now.Unix()).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrAccountLocked
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to record login attempt: %w", err)
+	}
+	if lockedUntil <= now.Unix() {
+		return time.Time{}, nil
+	}
+	return time.Unix(lockedUntil, 0), nil
+}
+
+// ResetLoginFailures follows a successful login. It also lifts a lock the successful attempt set.
+func (db *sqlStore) ResetLoginFailures(clientID int) error {
+	_, err := db.Exec("UPDATE clients SET failed_logins = 0, locked_until = 0 WHERE id = $1", clientID)
+	if err != nil {
+		return fmt.Errorf("failed to reset login failures: %w", err)
+	}
+	return nil
+}
+
+func (db *sqlStore) GetPasswordHash(clientID int) (string, error) {
+	var hash string
+	err := db.QueryRow("SELECT COALESCE(password_hash, '') FROM clients WHERE id = $1", clientID).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrClientNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get password hash: %w", err)
+	}
+	return hash, nil
+}
+
+// SetPassword replaces the client's password and revokes its refresh tokens, so sessions that were
+// started with the old password cannot outlive their access tokens.
+func (db *sqlStore) SetPassword(clientID int, hash string) error {
+	transaction, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	if _, err := transaction.Exec("UPDATE clients SET password_hash = $2, failed_logins = 0, locked_until = 0 WHERE id = $1", clientID, hash); err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+	if _, err := transaction.Exec("UPDATE refresh_tokens SET revoked = true WHERE client_id = $1", clientID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return transaction.Commit()
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"time"
+)
+
+var (
+	ErrNotChatMember   = errors.New("client is not a member of the chat")
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// GetRoles returns the client's server role and its role in the chat, if chatID is not empty.
+func (db *sqlStore) GetRoles(clientID int, chatID string) (models.Roles, error) {
+	var roles models.Roles
+	err := db.QueryRow("SELECT role FROM clients WHERE id = $1", clientID).Scan(&roles.Server)
+	if errors.Is(err, sql.ErrNoRows) {
+		return roles, ErrClientNotFound
+	}
+	if err != nil {
+		return roles, fmt.Errorf("failed to get server role: %w", err)
+	}
+	if chatID == "" {
+		return roles, nil
+	}
+	err = db.QueryRow("SELECT role FROM chat_members WHERE chat_id = $1 AND client_id = $2", chatID, clientID).Scan(&roles.Chat)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return roles, fmt.Errorf("failed to get chat role: %w", err)
+	}
+	return roles, nil
+}
+
+func (db *sqlStore) SetServerRole(clientID int, role string) error {
+	result, err := db.Exec("UPDATE clients SET role = $2 WHERE id = $1", clientID, role)
+	if err != nil {
+		return fmt.Errorf("failed to set server role: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func (db *sqlStore) SetChatRole(chatID string, clientID int, role string) error {
+	result, err := db.Exec("UPDATE chat_members SET role = $3 WHERE chat_id = $1 AND client_id = $2", chatID, clientID, role)
+	if err != nil {
+		return fmt.Errorf("failed to set chat role: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotChatMember
+	}
+	return nil
+}
+
+// GetMessageAuthor returns the chat a message was sent to and its sender.
+func (db *sqlStore) GetMessageAuthor(messageID int) (string, int, error) {
+	var chatID string
+	var clientID int
+	err := db.QueryRow("SELECT chat_id, client_id FROM messages WHERE id = $1", messageID).Scan(&chatID, &clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, ErrMessageNotFound
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get message author: %w", err)
+	}
+	return chatID, clientID, nil
+}
+
+// DeleteMessage removes the message together with its pending deliveries.
+func (db *sqlStore) DeleteMessage(messageID int) error {
+	result, err := db.Exec("DELETE FROM messages WHERE id = $1", messageID)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+func (db *sqlStore) RecordAudit(actorID int, action string, chatID string, target string) error {
+	query := `
+	INSERT INTO audit_log (actor_id, action, chat_id, target, created_at)
+	VALUES ($1, $2, $3, $4, $5);`
+	_, err := db.Exec(query, actorID, action, chatID, target, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// ListAuditLog returns up to limit entries older than beforeID, newest first. A zero beforeID
+// starts at the newest entry.
+func (db *sqlStore) ListAuditLog(beforeID int, limit int) ([]models.AuditEntry, error) {
+	query := `
+	SELECT id, COALESCE(actor_id, 0), action, chat_id, target, created_at
+	FROM audit_log
+	WHERE $1 = 0 OR id < $1
+	ORDER BY id DESC
+	LIMIT $2;`
+	rows, err := db.Query(query, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var entry models.AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.ActorID, &entry.Action, &entry.ChatID, &entry.Target, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
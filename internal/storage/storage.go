@@ -2,147 +2,415 @@ package storage
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/Schwarf/prototype_chat_server/internal/models"
 	"github.com/Schwarf/prototype_chat_server/pkg/config"
 	_ "github.com/lib/pq"
 	"log"
+	_ "modernc.org/sqlite"
+	"strings"
+	"time"
 )
 
-type DB struct {
+var (
+	ErrChatExists   = errors.New("chat already exists")
+	ErrChatNotFound = errors.New("chat not found")
+	ErrNotInvited   = errors.New("no pending invitation")
+	// ErrDuplicateMessage is returned with the acknowledgment of the message stored first
+	ErrDuplicateMessage = errors.New("message with this idempotency key already stored")
+)
+
+// dialect holds what differs between the SQL databases a sqlStore runs on.
+type dialect struct {
+	driver string
+	// serialKey declares an auto-incrementing integer primary key
+	serialKey string
+	// tablesQuery lists the names of all tables
+	tablesQuery string
+	// dropTable drops the named table together with everything referencing it
+	dropTable string
+	// suspendForeignKeys and resumeForeignKeys bracket migrations that copy tables, dropping the
+	// original would otherwise delete what references it. foreignKeyCheck lists broken references.
+	suspendForeignKeys string
+	resumeForeignKeys  string
+	foreignKeyCheck    string
+}
+
+var (
+	postgresDialect = dialect{
+		driver:      "postgres",
+		serialKey:   "SERIAL PRIMARY KEY",
+		tablesQuery: "SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' AND table_type = 'BASE TABLE'",
+		dropTable:   "DROP TABLE IF EXISTS %s CASCADE;",
+	}
+	sqliteDialect = dialect{
+		driver:      "sqlite",
+		serialKey:   "INTEGER PRIMARY KEY AUTOINCREMENT",
+		tablesQuery: "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'",
+		dropTable:   "DROP TABLE IF EXISTS %s;",
+
+		suspendForeignKeys: "PRAGMA foreign_keys = OFF;",
+		resumeForeignKeys:  "PRAGMA foreign_keys = ON;",
+		foreignKeyCheck:    "PRAGMA foreign_key_check;",
+	}
+)
+
+// sqlStore keeps the data in Postgres or SQLite. Its queries are written in the SQL both of them understand.
+type sqlStore struct {
 	*sql.DB
+	dialect dialect
+}
+
+// ConnectToDatabase opens the store selected by the configured driver. The schema of the SQL stores
+// is created and updated by their migrations, see CheckSchema.
+func ConnectToDatabase(databaseConfig *config.DatabaseConfig) (Store, error) {
+	var store *sqlStore
+	switch databaseConfig.Driver {
+	case "", config.DriverPostgres:
+		db, err := sql.Open(postgresDialect.driver, databaseConfig.ConnectionString())
+		if err != nil {
+			log.Printf("Connection to database failed: %v\n", err)
+			return nil, err
+		}
+		store = &sqlStore{DB: db, dialect: postgresDialect}
+	case config.DriverSQLite:
+		db, err := sql.Open(sqliteDialect.driver, "file:"+databaseConfig.Path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+		if err != nil {
+			log.Printf("Opening database file failed: %v\n", err)
+			return nil, err
+		}
+		// SQLite allows one writer at a time, a single connection queues them instead of failing them
+		db.SetMaxOpenConns(1)
+		store = &sqlStore{DB: db, dialect: sqliteDialect}
+	case config.DriverMemory:
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", databaseConfig.Driver)
+	}
+	return store, nil
 }
 
-func ConnectToDatabase(config *config.DatabaseConfig) (*DB, error) {
-	connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", config.Host, config.Port, config.User, config.Password, config.DBName)
-	db, err := sql.Open("postgres", connectionString)
+// StoreMessage stores the message together with a delivery for every member of its chat, pending for all
+// but the sender, and an outbox entry for the fan-out to the online sessions, so a stored message is never
+// lost on its way.
+// If the sender already stored a message under the same idempotency key, nothing is stored and the
+// original's acknowledgment is returned with ErrDuplicateMessage.
+func (db *sqlStore) StoreMessage(message models.Message, senderSession string) (*models.Acknowledgment, error) {
+	log.Println("Message: ", message.ChatID, message.Text)
+	transaction, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	ack := models.Acknowledgment{ChatID: message.ChatID, Timestamp_ms: time.Now().UnixMilli()}
+	// Counting up the chat's row holds back other senders to the chat until this transaction ends,
+	// a duplicate rolls the number back
+	err = transaction.QueryRow("UPDATE chats SET last_seq = last_seq + 1 WHERE chat_id = $1 RETURNING last_seq", message.ChatID).Scan(&ack.Seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrChatNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign sequence number: %w", err)
+	}
+	query := `
+	INSERT INTO messages (client_id, chat_id, text, timestamp_ms, hash, idempotency_key, stored_at_ms, seq)
+	VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8)
+	ON CONFLICT (client_id, idempotency_key) DO NOTHING
+	RETURNING id;`
+	err = transaction.QueryRow(query, message.ClientID, message.ChatID, message.Text, message.Timestamp_ms, message.Hash,
+		message.IdempotencyKey, ack.Timestamp_ms, ack.Seq).Scan(&ack.MessageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Only a message with the same key suppresses the insert
+		original, err := messageByKey(transaction, message.ClientID, message.IdempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		return original, ErrDuplicateMessage
+	}
 	if err != nil {
-		log.Printf("Connection to database failed: %v\n", err)
 		return nil, err
 	}
-	if err := createTables(db); err != nil {
-		log.Printf("Creating tables failed: %v\n", err)
+	// The sender gets a delivery too, already acknowledged, so that its other devices replay the message
+	query = `
+	INSERT INTO message_deliveries (message_id, client_id, delivered)
+	SELECT $1, client_id, client_id = $3
+	FROM chat_members
+	WHERE chat_id = $2;`
+	_, err = transaction.Exec(query, ack.MessageID, message.ChatID, message.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store deliveries: %w", err)
+	}
+	_, err = transaction.Exec("INSERT INTO outbox (message_id, sender_session, created_at) VALUES ($1, $2, $3)",
+		ack.MessageID, senderSession, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store outbox entry: %w", err)
 	}
+	return &ack, transaction.Commit()
+}
 
-	return &DB{db}, nil
+// queryRower is what *sql.DB and *sql.Tx have in common for single row queries.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
-func createTables(db *sql.DB) error {
-	query := `CREATE TABLE IF NOT EXISTS clients (
-		id SERIAL PRIMARY KEY,
-		username TEXT UNIQUE NOT NULL,
-		token TEXT UNIQUE NOT NULL,
-	    salt TEXT UNIQUE NOT NULL
-	);`
-	_, err := db.Exec(query)
+func messageByKey(db queryRower, clientID int, key string) (*models.Acknowledgment, error) {
+	var ack models.Acknowledgment
+	err := db.QueryRow("SELECT id, chat_id, stored_at_ms, seq FROM messages WHERE client_id = $1 AND idempotency_key = $2", clientID, key).
+		Scan(&ack.MessageID, &ack.ChatID, &ack.Timestamp_ms, &ack.Seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to look up idempotency key: %w", err)
 	}
-	query = `CREATE TABLE IF NOT EXISTS chats (
-		id SERIAL PRIMARY KEY,
-		client_id INT REFERENCES clients(id) ON DELETE CASCADE,
-		chat_id TEXT UNIQUE NOT NULL
-	);`
-	_, err = db.Exec(query)
+	return &ack, nil
+}
+
+// GetMessageByKey returns the acknowledgment of the message the client stored under the idempotency key.
+func (db *sqlStore) GetMessageByKey(clientID int, key string) (*models.Acknowledgment, error) {
+	return messageByKey(db, clientID, key)
+}
+
+func (db *sqlStore) AddClient(username string, salt string) (int, error) {
+	query := `
+	INSERT INTO clients (username, salt)
+	VALUES ($1, $2)
+	RETURNING id;`
+	var clientID int
+	err := db.QueryRow(query, username, salt).Scan(&clientID)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to add client: %w", err)
 	}
-	query = `CREATE TABLE IF NOT EXISTS messages (
-		id SERIAL PRIMARY KEY,
-		chat_id TEXT REFERENCES chats(chat_id) ON DELETE CASCADE,
-		client_id INT REFERENCES clients(id) ON DELETE CASCADE,
-		text TEXT,
-		timestamp_ms BIGINT,
-		hash TEXT,
-		delivered BOOLEAN DEFAULT FALSE
-	);`
-	_, err = db.Exec(query)
+	return clientID, nil
+}
+
+// AddChat creates the chat if it does not exist yet and makes the client a member of it.
+func (db *sqlStore) AddChat(clientID int, chatID string, kind string) error {
+	query := `
+	INSERT INTO chats (client_id, chat_id, kind)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (chat_id) DO NOTHING;`
+	_, err := db.Exec(query, clientID, chatID, kind)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to store chat: %w", err)
 	}
+	return db.AddChatMember(chatID, clientID)
+}
 
-	query = `CREATE TABLE IF NOT EXISTS secrets (
-		id SERIAL PRIMARY KEY,
-		secret TEXT UNIQUE NOT NULL,
-		used BOOLEAN DEFAULT FALSE
-	);`
-	_, err = db.Exec(query)
+// CreateChat creates a new group chat owned by clientID with the given members.
+// It returns ErrChatExists if the chat ID is already taken.
+func (db *sqlStore) CreateChat(clientID int, chatID string, name string, memberIDs []int) error {
+	transaction, err := db.Begin()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer transaction.Rollback()
 
-	return nil
+	result, err := transaction.Exec(`
+	INSERT INTO chats (client_id, chat_id, name, kind)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (chat_id) DO NOTHING;`, clientID, chatID, name, models.ChatKindGroup)
+	if err != nil {
+		return fmt.Errorf("failed to store chat: %w", err)
+	}
+	if inserted, err := result.RowsAffected(); err == nil && inserted == 0 {
+		return ErrChatExists
+	}
+	_, err = transaction.Exec("INSERT INTO chat_members (chat_id, client_id, role) VALUES ($1, $2, $3)", chatID, clientID, models.ChatRoleOwner)
+	if err != nil {
+		return fmt.Errorf("failed to add owner to chat: %w", err)
+	}
+	for _, memberID := range memberIDs {
+		_, err = transaction.Exec(`
+		INSERT INTO chat_members (chat_id, client_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;`, chatID, memberID)
+		if err != nil {
+			return fmt.Errorf("failed to add member %d to chat: %w", memberID, err)
+		}
+	}
+	return transaction.Commit()
 }
 
-func MarkSecretAsUsed(db *DB, secret string) error {
-	_, err := db.Exec("INSERT INTO secrets (secret, used) VALUES ($1, $2)", secret, true)
+func (db *sqlStore) AddChatMember(chatID string, clientID int) error {
+	query := `
+	INSERT INTO chat_members (chat_id, client_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING;`
+	_, err := db.Exec(query, chatID, clientID)
 	if err != nil {
-		log.Printf("Marking secret as used: %v\n", err)
-		return err
+		return fmt.Errorf("failed to add chat member: %w", err)
 	}
 	return nil
 }
 
-func StoreMessage(db *DB, message models.Message) error {
-	log.Println("Message: ", message.ChatID, message.Text)
-	if message.ChatID == "" {
-		message.ChatID = "self"
-		log.Println("Chat ID is empty!")
-		err := AddChat(db, message.ClientID, message.ChatID)
-		if err != nil {
-			log.Println("Error adding chat id to chat: ", err)
-			return err
-		}
+// AddDirectChat creates the one-to-one chat between two clients if it does not exist yet.
+func (db *sqlStore) AddDirectChat(clientID int, recipientID int, chatID string) error {
+	if err := db.AddChat(clientID, chatID, models.ChatKindDirect); err != nil {
+		return err
+	}
+	return db.AddChatMember(chatID, recipientID)
+}
+
+func (db *sqlStore) GetChat(chatID string) (*models.Chat, error) {
+	var chat models.Chat
+	query := `
+	SELECT chat_id, name, kind, client_id
+	FROM chats
+	WHERE chat_id = $1;`
+	err := db.QueryRow(query, chatID).Scan(&chat.ChatID, &chat.Name, &chat.Kind, &chat.CreatedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrChatNotFound
 	}
-	_, err := db.Exec("INSERT INTO messages (client_id, chat_id, text, timestamp_ms, hash) VALUES ($1, $2, $3, $4, $5)",
-		message.ClientID, message.ChatID, message.Text, message.Timestamp_ms, message.Hash)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to get chat: %w", err)
+	}
+	return &chat, nil
+}
+
+func (db *sqlStore) RemoveChatMember(chatID string, clientID int) error {
+	_, err := db.Exec("DELETE FROM chat_members WHERE chat_id = $1 AND client_id = $2", chatID, clientID)
+	if err != nil {
+		return fmt.Errorf("failed to remove chat member: %w", err)
 	}
 	return nil
 }
 
-func AddClient(db *DB, username, token string, salt string) (int, error) {
+func (db *sqlStore) InviteToChat(chatID string, clientID int, invitedBy int) error {
 	query := `
-	INSERT INTO clients (username, token, salt)
+	INSERT INTO chat_invitations (chat_id, client_id, invited_by)
 	VALUES ($1, $2, $3)
-	RETURNING id;`
-	var clientID int
-	err := db.QueryRow(query, username, token, salt).Scan(&clientID)
+	ON CONFLICT DO NOTHING;`
+	_, err := db.Exec(query, chatID, clientID, invitedBy)
 	if err != nil {
-		return 0, fmt.Errorf("failed to add client: %w", err)
+		return fmt.Errorf("failed to store invitation: %w", err)
 	}
-	return clientID, nil
+	return nil
 }
 
-func AddChat(db *DB, clientID int, chatID string) error {
-	query := `
-	INSERT INTO chats (client_id, chat_id)
+// AcceptInvitation consumes the client's pending invitation and makes the client a member of the chat.
+// It returns ErrNotInvited if there is no invitation to consume.
+func (db *sqlStore) AcceptInvitation(chatID string, clientID int) error {
+	transaction, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	result, err := transaction.Exec("DELETE FROM chat_invitations WHERE chat_id = $1 AND client_id = $2", chatID, clientID)
+	if err != nil {
+		return fmt.Errorf("failed to consume invitation: %w", err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return ErrNotInvited
+	}
+	_, err = transaction.Exec(`
+	INSERT INTO chat_members (chat_id, client_id)
 	VALUES ($1, $2)
-	ON CONFLICT (chat_id) DO NOTHING;`
-	_, err := db.Exec(query, clientID, chatID)
+	ON CONFLICT DO NOTHING;`, chatID, clientID)
 	if err != nil {
-		return fmt.Errorf("failed to store chat: %w", err)
+		return fmt.Errorf("failed to add chat member: %w", err)
 	}
-	return nil
+	return transaction.Commit()
 }
 
-func GetClientIDAndSalt(db *DB, token string) (int, string, error) {
-	var clientID int
+func (db *sqlStore) GetChatMemberDetails(chatID string) ([]models.ChatMember, error) {
+	query := `
+	SELECT clients.id, clients.username, chat_members.role
+	FROM chat_members
+	JOIN clients ON clients.id = chat_members.client_id
+	WHERE chat_members.chat_id = $1
+	ORDER BY clients.id;`
+	rows, err := db.Query(query, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []models.ChatMember{}
+	for rows.Next() {
+		var member models.ChatMember
+		if err := rows.Scan(&member.ClientID, &member.Username, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (db *sqlStore) GetChatMembers(chatID string) ([]int, error) {
+	rows, err := db.Query("SELECT client_id FROM chat_members WHERE chat_id = $1", chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat members: %w", err)
+	}
+	defer rows.Close()
+
+	var clientIDs []int
+	for rows.Next() {
+		var clientID int
+		if err := rows.Scan(&clientID); err != nil {
+			return nil, err
+		}
+		clientIDs = append(clientIDs, clientID)
+	}
+	return clientIDs, rows.Err()
+}
+
+func (db *sqlStore) GetClientSalt(clientID int) (string, error) {
 	var salt string
 	query := `
-	SELECT id, salt
+	SELECT salt
 	FROM clients
-	WHERE token = $1;`
-	err := db.QueryRow(query, token).Scan(&clientID, &salt)
+	WHERE id = $1;`
+	err := db.QueryRow(query, clientID).Scan(&salt)
+	if err != nil {
+		return "", fmt.Errorf("failed to get salt of client: %w", err)
+	}
+	return salt, nil
+}
+
+func (db *sqlStore) GetClientUsername(clientID int) (string, error) {
+	var username string
+	err := db.QueryRow("SELECT username FROM clients WHERE id = $1", clientID).Scan(&username)
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to get client by token: %w", err)
+		return "", fmt.Errorf("failed to get username of client: %w", err)
 	}
-	return clientID, salt, nil
+	return username, nil
+}
+
+func (db *sqlStore) GetClientIDByUsername(username string) (int, error) {
+	var clientID int
+	err := db.QueryRow("SELECT id FROM clients WHERE username = $1", username).Scan(&clientID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get client by username: %w", err)
+	}
+	return clientID, nil
 }
 
-func RetrieveUndeliveredMessages(db *DB) ([]models.DBMessage, error) {
-	rows, err := db.Query("SELECT id, chat_id, client_id, text, timestamp_ms, hash FROM messages WHERE delivered = false")
+func (db *sqlStore) ClientExists(clientID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM clients WHERE id = $1)", clientID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up client: %w", err)
+	}
+	return exists, nil
+}
+
+// RetrieveUndeliveredMessages returns the messages addressed to the client with an ID above afterID that
+// the device has not received, oldest first.
+func (db *sqlStore) RetrieveUndeliveredMessages(clientID int, deviceID string, afterID int) ([]models.DBMessage, error) {
+	query := `
+	SELECT messages.id, messages.client_id, messages.chat_id, messages.text, messages.timestamp_ms, messages.hash, messages.seq
+	FROM message_deliveries
+	JOIN messages ON messages.id = message_deliveries.message_id
+	WHERE message_deliveries.client_id = $1 AND messages.id > $2 AND NOT EXISTS (
+		SELECT 1 FROM device_deliveries
+		WHERE device_deliveries.client_id = $1 AND device_deliveries.device_id = $3
+		AND device_deliveries.message_id = messages.id)
+	ORDER BY messages.id;`
+	rows, err := db.Query(query, clientID, afterID, deviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -151,44 +419,199 @@ func RetrieveUndeliveredMessages(db *DB) ([]models.DBMessage, error) {
 	var messages []models.DBMessage
 	for rows.Next() {
 		var message models.DBMessage
-		if err := rows.Scan(&message.DBID, &message.ClientID, &message.ChatID, &message.Text, &message.Timestamp_ms, &message.Hash); err != nil {
+		if err := rows.Scan(&message.DBID, &message.ClientID, &message.ChatID, &message.Text, &message.Timestamp_ms, &message.Hash, &message.Seq); err != nil {
 			return nil, err
 		}
 		messages = append(messages, message)
 	}
-	return messages, nil
+	return messages, rows.Err()
 }
 
-func UpdateMessageStatus(db *DB, messageID int, deliveredToClient bool) error {
-	_, err := db.Exec("UPDATE messages SET delivered_to_client = ? WHERE id = ?", deliveredToClient, messageID)
+// GetDeviceCursor returns the ID of the last message the device acknowledged. A device seen for the
+// first time starts right before the oldest message none of the client's devices has acknowledged.
+func (db *sqlStore) GetDeviceCursor(clientID int, deviceID string) (int, error) {
+	query := `
+	INSERT INTO device_cursors (client_id, device_id, delivered_up_to)
+	VALUES ($1, $2, COALESCE(
+		(SELECT MIN(message_id) - 1 FROM message_deliveries WHERE client_id = $1 AND delivered = false),
+		(SELECT MAX(message_id) FROM message_deliveries WHERE client_id = $1),
+		0))
+	ON CONFLICT (client_id, device_id) DO NOTHING;`
+	if _, err := db.Exec(query, clientID, deviceID); err != nil {
+		return 0, fmt.Errorf("failed to create device cursor: %w", err)
+	}
+	var deliveredUpTo int
+	err := db.QueryRow("SELECT delivered_up_to FROM device_cursors WHERE client_id = $1 AND device_id = $2", clientID, deviceID).Scan(&deliveredUpTo)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to get device cursor: %w", err)
 	}
-	return nil
+	return deliveredUpTo, nil
 }
 
-func DropAllTables(db *sql.DB) error {
-	// Query to get all table names
-	query := `
-        SELECT table_name
-        FROM information_schema.tables
-        WHERE table_schema = 'public'
-        AND table_type = 'BASE TABLE';
-    `
-	rows, err := db.Query(query)
+// AdvanceDeviceCursor records that the device received a message addressed to the client. The cursor
+// moves up to right before the oldest message the device has not received, so acknowledging out of
+// order never skips a message.
+func (db *sqlStore) AdvanceDeviceCursor(clientID int, deviceID string, messageID int) error {
+	transaction, err := db.Begin()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	_, err = transaction.Exec(`
+	INSERT INTO device_deliveries (client_id, device_id, message_id)
+	SELECT client_id, $2, message_id
+	FROM message_deliveries
+	WHERE client_id = $1 AND message_id = $3
+	ON CONFLICT DO NOTHING;`, clientID, deviceID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to store device delivery: %w", err)
+	}
+	_, err = transaction.Exec(`
+	UPDATE device_cursors
+	SET delivered_up_to = COALESCE(
+		(SELECT MIN(message_id) - 1
+		FROM message_deliveries
+		WHERE client_id = $1 AND message_id > device_cursors.delivered_up_to AND NOT EXISTS (
+			SELECT 1 FROM device_deliveries
+			WHERE device_deliveries.client_id = $1 AND device_deliveries.device_id = $2
+			AND device_deliveries.message_id = message_deliveries.message_id)),
+		(SELECT MAX(message_id) FROM message_deliveries WHERE client_id = $1 AND message_id > device_cursors.delivered_up_to),
+		delivered_up_to)
+	WHERE client_id = $1 AND device_id = $2;`, clientID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to advance device cursor: %w", err)
+	}
+	// Deliveries the cursor passed are implied by it
+	_, err = transaction.Exec(`
+	DELETE FROM device_deliveries
+	WHERE client_id = $1 AND device_id = $2 AND message_id <= (
+		SELECT delivered_up_to FROM device_cursors WHERE client_id = $1 AND device_id = $2);`, clientID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to prune device deliveries: %w", err)
+	}
+	return transaction.Commit()
+}
+
+// MarkMessageDelivered flags the message as delivered to the client once one of its devices acknowledged it.
+// It reports false if the message had already been acknowledged or was never addressed to the client.
+func (db *sqlStore) MarkMessageDelivered(messageID int, clientID int) (bool, error) {
+	result, err := db.Exec("UPDATE message_deliveries SET delivered = true WHERE message_id = $1 AND client_id = $2 AND delivered = false", messageID, clientID)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// RetrieveMessageHistory returns one page of a chat's history as selected by the query.
+func (db *sqlStore) RetrieveMessageHistory(query models.HistoryQuery) (*models.HistoryPage, error) {
+	query.Normalize()
+	order := "DESC"
+	if query.Forward() {
+		order = "ASC"
+	}
+	// Only the bounds the query sets become conditions
+	conditions := []string{"chat_id = $1"}
+	args := []interface{}{query.ChatID}
+	bound := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if query.Before != 0 {
+		bound("id < $%d", query.Before)
+	}
+	if query.After != 0 {
+		bound("id > $%d", query.After)
+	}
+	if query.BeforeSeq != 0 {
+		bound("seq < $%d", query.BeforeSeq)
+	}
+	if query.AfterSeq != 0 {
+		bound("seq > $%d", query.AfterSeq)
+	}
+	if query.BeforeMs != 0 {
+		bound("timestamp_ms < $%d", query.BeforeMs)
+	}
+	if query.AfterMs != 0 {
+		bound("timestamp_ms > $%d", query.AfterMs)
+	}
+	// One more row than requested tells whether there is another page
+	args = append(args, query.Limit+1)
+	statement := fmt.Sprintf(`
+	SELECT id, client_id, chat_id, text, timestamp_ms, hash, seq
+	FROM messages
+	WHERE %s
+	ORDER BY id %s
+	LIMIT $%d;`, strings.Join(conditions, " AND "), order, len(args))
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve message history: %w", err)
 	}
 	defer rows.Close()
 
-	// Loop through results and drop each table
+	page := &models.HistoryPage{ChatID: query.ChatID, Messages: []models.Message{}}
+	for rows.Next() {
+		var message models.DBMessage
+		if err := rows.Scan(&message.DBID, &message.ClientID, &message.ChatID, &message.Text, &message.Timestamp_ms, &message.Hash, &message.Seq); err != nil {
+			return nil, err
+		}
+		page.Messages = append(page.Messages, message.Message())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// SQLite's single connection is busy until the rows are closed
+	rows.Close()
+	// A chat that does not exist has no messages either
+	err = db.QueryRow("SELECT last_seq FROM chats WHERE chat_id = $1", query.ChatID).Scan(&page.LastSeq)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get last sequence number: %w", err)
+	}
+	return finishPage(page, query), nil
+}
+
+// finishPage cuts the extra message off a page read in the query's direction and puts the page in
+// chronological order.
+func finishPage(page *models.HistoryPage, query models.HistoryQuery) *models.HistoryPage {
+	if len(page.Messages) > query.Limit {
+		page.Messages = page.Messages[:query.Limit]
+		page.HasMore = true
+	}
+	if !query.Forward() {
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	return page
+}
+
+// DropAllTables drops every table of the database, not only the ones the store created.
+func (db *sqlStore) DropAllTables() error {
+	rows, err := db.Query(db.dialect.tablesQuery)
+	if err != nil {
+		return err
+	}
+	// The names are collected first, SQLite's single connection is busy until the rows are closed
+	var tableNames []string
 	for rows.Next() {
 		var tableName string
 		if err := rows.Scan(&tableName); err != nil {
+			rows.Close()
 			return err
 		}
-		dropStmt := fmt.Sprintf("DROP TABLE IF EXISTS %s CASCADE;", tableName)
-		if _, err := db.Exec(dropStmt); err != nil {
+		tableNames = append(tableNames, tableName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, tableName := range tableNames {
+		if _, err := db.Exec(fmt.Sprintf(db.dialect.dropTable, tableName)); err != nil {
 			return err
 		}
 		fmt.Printf("Dropped table %s\n", tableName)
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"time"
+)
+
+// Store is everything the server keeps beyond the lifetime of a connection. ConnectToDatabase
+// returns the implementation the configuration selects, all of them report the same errors.
+type Store interface {
+	ClientStore
+	ChatStore
+	MessageStore
+	InviteStore
+	TokenStore
+	AuditStore
+	Migrator
+
+	// DropAllTables deletes all stored data.
+	DropAllTables() error
+	Close() error
+}
+
+// ClientStore keeps the registered clients with their credentials and server roles.
+type ClientStore interface {
+	AddClient(username string, salt string) (int, error)
+	ClientExists(clientID int) (bool, error)
+	GetClientSalt(clientID int) (string, error)
+	GetClientUsername(clientID int) (string, error)
+	GetClientIDByUsername(username string) (int, error)
+
+	// GetLoginState returns ErrClientNotFound for an unknown username.
+	GetLoginState(username string) (*LoginState, error)
+	// RecordLoginAttempt counts the attempt as failed unless the account is locked, which returns
+	// ErrAccountLocked. It returns the time the attempt locked the account until, or zero.
+	RecordLoginAttempt(clientID int, maxFailures int, lockout time.Duration) (time.Time, error)
+	// ResetLoginFailures clears the count and the lock after a successful attempt.
+	ResetLoginFailures(clientID int) error
+	// GetPasswordHash returns an empty hash for clients without a password.
+	GetPasswordHash(clientID int) (string, error)
+	// SetPassword also revokes the client's refresh tokens.
+	SetPassword(clientID int, hash string) error
+
+	// ProvisionIdentityClient returns the client linked to the subject, creating it on first login.
+	ProvisionIdentityClient(issuer string, subject string, username string, salt string) (*models.Client, error)
+
+	// GetRoles leaves the chat role empty if the client is not a member of the chat.
+	GetRoles(clientID int, chatID string) (models.Roles, error)
+	SetServerRole(clientID int, role string) error
+}
+
+// ChatStore keeps chats, their members and pending invitations to them.
+type ChatStore interface {
+	AddChat(clientID int, chatID string, kind string) error
+	AddDirectChat(clientID int, recipientID int, chatID string) error
+	// CreateChat returns ErrChatExists if the chat ID is taken.
+	CreateChat(clientID int, chatID string, name string, memberIDs []int) error
+	// GetChat returns ErrChatNotFound for an unknown chat.
+	GetChat(chatID string) (*models.Chat, error)
+
+	AddChatMember(chatID string, clientID int) error
+	RemoveChatMember(chatID string, clientID int) error
+	GetChatMembers(chatID string) ([]int, error)
+	GetChatMemberDetails(chatID string) ([]models.ChatMember, error)
+	// SetChatRole returns ErrNotChatMember if the client is not a member of the chat.
+	SetChatRole(chatID string, clientID int, role string) error
+
+	InviteToChat(chatID string, clientID int, invitedBy int) error
+	// AcceptInvitation returns ErrNotInvited if there is no invitation to consume.
+	AcceptInvitation(chatID string, clientID int) error
+}
+
+// MessageStore keeps messages, the outbox of their fan-out and which recipient and device they were
+// delivered to.
+type MessageStore interface {
+	// StoreMessage also queues the message in the outbox, senderSession is left out of its fan-out.
+	// A repeated idempotency key returns the original's acknowledgment with ErrDuplicateMessage.
+	StoreMessage(message models.Message, senderSession string) (*models.Acknowledgment, error)
+	// GetMessageByKey returns ErrMessageNotFound if the client stored nothing under the key.
+	GetMessageByKey(clientID int, key string) (*models.Acknowledgment, error)
+	RetrieveUndeliveredMessages(clientID int, deviceID string, afterID int) ([]models.DBMessage, error)
+	RetrieveMessageHistory(query models.HistoryQuery) (*models.HistoryPage, error)
+	// GetMessageAuthor returns the chat and sender of a message or ErrMessageNotFound.
+	GetMessageAuthor(messageID int) (string, int, error)
+	DeleteMessage(messageID int) error
+
+	GetDeviceCursor(clientID int, deviceID string) (int, error)
+	AdvanceDeviceCursor(clientID int, deviceID string, messageID int) error
+	MarkMessageDelivered(messageID int, clientID int) (bool, error)
+
+	// PendingOutbox returns up to limit entries that still wait for their fan-out, oldest first.
+	PendingOutbox(limit int) ([]OutboxEntry, error)
+	CompleteOutboxEntry(entryID int) error
+}
+
+// InviteStore keeps the invite codes, the secrets clients register with.
+type InviteStore interface {
+	CreateInvite(code string, createdBy int, maxUses int, expiresAt time.Time) (*models.Invite, error)
+	SeedInvites(codes []string) error
+	ListInvites() ([]models.Invite, error)
+	// RevokeInvite returns ErrInviteNotFound for an unknown invite.
+	RevokeInvite(inviteID int) error
+	// RegisterClientWithInvite returns ErrInviteInvalid or ErrUsernameTaken without using up the invite.
+	RegisterClientWithInvite(code string, username string, salt string, passwordHash string, role string) (int, error)
+}
+
+// TokenStore keeps refresh tokens and revoked access tokens.
+type TokenStore interface {
+	StoreRefreshToken(clientID int, tokenHash string, expiresAt time.Time) error
+	// RotateRefreshToken returns ErrRefreshTokenInvalid or ErrRefreshTokenReused together with the
+	// client whose tokens were all revoked.
+	RotateRefreshToken(oldHash string, newHash string, expiresAt time.Time) (int, error)
+	RevokeRefreshToken(clientID int, tokenHash string) (bool, error)
+	RevokeAccessToken(clientID int, tokenID string, expiresAt time.Time) error
+	LoadRevokedTokens() (map[string]time.Time, error)
+}
+
+// AuditStore keeps the log of privileged actions.
+type AuditStore interface {
+	RecordAudit(actorID int, action string, chatID string, target string) error
+	ListAuditLog(beforeID int, limit int) ([]models.AuditEntry, error)
+}
+
+// Migrator moves the schema between the versions of the migrations.
+type Migrator interface {
+	MigrationStatus() ([]MigrationState, error)
+	// MigrateUp returns the versions it applied, also when a later migration failed.
+	MigrateUp() ([]int, error)
+	// MigrateDown returns ErrNoMigration if no migration is applied.
+	MigrateDown() (int, error)
+}
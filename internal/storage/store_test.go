@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"errors"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/Schwarf/prototype_chat_server/pkg/config"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openSQLite returns a migrated SQLite store in a fresh database file.
+func openSQLite(t *testing.T) Store {
+	store, err := ConnectToDatabase(&config.DatabaseConfig{Driver: config.DriverSQLite, Path: filepath.Join(t.TempDir(), "chat.db")})
+	if err != nil {
+		t.Fatalf("failed to open SQLite store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.MigrateUp(); err != nil {
+		t.Fatalf("failed to migrate SQLite store: %v", err)
+	}
+	return store
+}
+
+// forEachStore runs the test against every Store implementation, they have to behave the same.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) { test(t, newMemoryStore()) })
+	t.Run("sqlite", func(t *testing.T) { test(t, openSQLite(t)) })
+}
+
+func addClient(store Store, username string, t *testing.T) int {
+	clientID, err := store.AddClient(username, username+"-salt")
+	if err != nil {
+		t.Fatalf("failed to add client %s: %v", username, err)
+	}
+	return clientID
+}
+
+func TestLoginAttemptsInParallel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		clientID := addClient(store, "guessed", t)
+
+		// Only maxFailures of many parallel attempts get to check a password
+		var waitGroup sync.WaitGroup
+		var mutex sync.Mutex
+		allowed, locking := 0, 0
+		for i := 0; i < 20; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				lockedUntil, err := store.RecordLoginAttempt(clientID, 5, time.Minute)
+				if err != nil && !errors.Is(err, ErrAccountLocked) {
+					t.Errorf("unexpected error: %v", err)
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err == nil {
+					allowed++
+				}
+				if !lockedUntil.IsZero() {
+					locking++
+				}
+			}()
+		}
+		waitGroup.Wait()
+		if allowed != 5 || locking != 1 {
+			t.Fatalf("expected 5 attempts with one locking the account, got %d with %d locking", allowed, locking)
+		}
+
+		// A successful attempt lifts the lock it set
+		if err := store.ResetLoginFailures(clientID); err != nil {
+			t.Fatalf("failed to reset login failures: %v", err)
+		}
+		if lockedUntil, err := store.RecordLoginAttempt(clientID, 5, time.Minute); err != nil || !lockedUntil.IsZero() {
+			t.Fatalf("expected an attempt after the reset, got %v, %v", lockedUntil, err)
+		}
+	})
+}
+
+// storeMessages stores one message per text in the chat and returns their acknowledgments.
+func storeMessages(store Store, clientID int, chatID string, texts []string, t *testing.T) []models.Acknowledgment {
+	var acks []models.Acknowledgment
+	for i, text := range texts {
+		ack, err := store.StoreMessage(models.Message{ClientID: clientID, ChatID: chatID, Text: text, Timestamp_ms: int64(1000 * (i + 1))}, "session")
+		if err != nil {
+			t.Fatalf("failed to store message %q: %v", text, err)
+		}
+		acks = append(acks, *ack)
+	}
+	return acks
+}
+
+func messageIDs(messages []models.DBMessage) []int {
+	var ids []int
+	for _, message := range messages {
+		ids = append(ids, message.DBID)
+	}
+	return ids
+}
+
+func TestChats(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		owner := addClient(store, "owner", t)
+		member := addClient(store, "member", t)
+		outsider := addClient(store, "outsider", t)
+
+		if err := store.CreateChat(owner, "group", "Group", []int{member}); err != nil {
+			t.Fatalf("failed to create chat: %v", err)
+		}
+		if err := store.CreateChat(member, "group", "Taken", nil); !errors.Is(err, ErrChatExists) {
+			t.Fatalf("expected ErrChatExists, got %v", err)
+		}
+		if _, err := store.GetChat("missing"); !errors.Is(err, ErrChatNotFound) {
+			t.Fatalf("expected ErrChatNotFound, got %v", err)
+		}
+		chat, err := store.GetChat("group")
+		if err != nil || chat.Name != "Group" || chat.Kind != models.ChatKindGroup {
+			t.Fatalf("unexpected chat %+v, %v", chat, err)
+		}
+
+		roles, err := store.GetRoles(owner, "group")
+		if err != nil || roles.Chat != models.ChatRoleOwner {
+			t.Fatalf("expected the creator to own the chat, got %+v, %v", roles, err)
+		}
+		if err := store.SetChatRole("group", outsider, models.ChatRoleModerator); !errors.Is(err, ErrNotChatMember) {
+			t.Fatalf("expected ErrNotChatMember, got %v", err)
+		}
+
+		// An invitation is consumed by accepting it
+		if err := store.AcceptInvitation("group", outsider); !errors.Is(err, ErrNotInvited) {
+			t.Fatalf("expected ErrNotInvited, got %v", err)
+		}
+		if err := store.InviteToChat("group", outsider, owner); err != nil {
+			t.Fatalf("failed to invite: %v", err)
+		}
+		if err := store.AcceptInvitation("group", outsider); err != nil {
+			t.Fatalf("failed to accept invitation: %v", err)
+		}
+		if err := store.AcceptInvitation("group", outsider); !errors.Is(err, ErrNotInvited) {
+			t.Fatalf("expected the invitation to be used up, got %v", err)
+		}
+		members, err := store.GetChatMembers("group")
+		sort.Ints(members)
+		if err != nil || !reflect.DeepEqual(members, []int{owner, member, outsider}) {
+			t.Fatalf("unexpected members %v, %v", members, err)
+		}
+
+		if err := store.RemoveChatMember("group", member); err != nil {
+			t.Fatalf("failed to remove member: %v", err)
+		}
+		if roles, err := store.GetRoles(member, "group"); err != nil || roles.Chat != "" {
+			t.Fatalf("expected no chat role after leaving, got %+v, %v", roles, err)
+		}
+	})
+}
+
+func TestStoreMessage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		sender := addClient(store, "sender", t)
+		recipient := addClient(store, "recipient", t)
+		if err := store.CreateChat(sender, "first", "First", []int{recipient}); err != nil {
+			t.Fatalf("failed to create chat: %v", err)
+		}
+		if err := store.CreateChat(sender, "second", "Second", []int{recipient}); err != nil {
+			t.Fatalf("failed to create chat: %v", err)
+		}
+
+		// Every chat counts its own sequence numbers
+		acks := storeMessages(store, sender, "first", []string{"a", "b"}, t)
+		acks = append(acks, storeMessages(store, sender, "second", []string{"c"}, t)...)
+		if acks[0].Seq != 1 || acks[1].Seq != 2 || acks[2].Seq != 1 {
+			t.Fatalf("unexpected sequence numbers %+v", acks)
+		}
+
+		keyed := models.Message{ClientID: sender, ChatID: "first", Text: "once", IdempotencyKey: "key"}
+		original, err := store.StoreMessage(keyed, "session")
+		if err != nil {
+			t.Fatalf("failed to store keyed message: %v", err)
+		}
+		again, err := store.StoreMessage(keyed, "session")
+		if !errors.Is(err, ErrDuplicateMessage) || again.MessageID != original.MessageID || again.Seq != original.Seq {
+			t.Fatalf("expected the original acknowledgment with ErrDuplicateMessage, got %+v, %v", again, err)
+		}
+		if found, err := store.GetMessageByKey(sender, "key"); err != nil || found.MessageID != original.MessageID {
+			t.Fatalf("expected the keyed message, got %+v, %v", found, err)
+		}
+		if _, err := store.GetMessageByKey(recipient, "key"); !errors.Is(err, ErrMessageNotFound) {
+			t.Fatalf("expected keys to be scoped to the sender, got %v", err)
+		}
+
+		chatID, author, err := store.GetMessageAuthor(acks[1].MessageID)
+		if err != nil || chatID != "first" || author != sender {
+			t.Fatalf("unexpected author %s, %d, %v", chatID, author, err)
+		}
+		if err := store.DeleteMessage(acks[1].MessageID); err != nil {
+			t.Fatalf("failed to delete message: %v", err)
+		}
+		if _, _, err := store.GetMessageAuthor(acks[1].MessageID); !errors.Is(err, ErrMessageNotFound) {
+			t.Fatalf("expected ErrMessageNotFound after deleting, got %v", err)
+		}
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		sender := addClient(store, "sender", t)
+		if err := store.CreateChat(sender, "chat", "Chat", nil); err != nil {
+			t.Fatalf("failed to create chat: %v", err)
+		}
+		acks := storeMessages(store, sender, "chat", []string{"a", "b", "c"}, t)
+
+		pending, err := store.PendingOutbox(2)
+		if err != nil || len(pending) != 2 {
+			t.Fatalf("expected two pending entries, got %+v, %v", pending, err)
+		}
+		if pending[0].Message.DBID != acks[0].MessageID || pending[0].Message.Text != "a" || pending[0].SenderSession != "session" {
+			t.Fatalf("expected the oldest message first, got %+v", pending[0])
+		}
+		if err := store.CompleteOutboxEntry(pending[0].ID); err != nil {
+			t.Fatalf("failed to complete outbox entry: %v", err)
+		}
+		pending, err = store.PendingOutbox(10)
+		if err != nil || len(pending) != 2 || pending[0].Message.DBID != acks[1].MessageID {
+			t.Fatalf("expected the completed entry to be gone, got %+v, %v", pending, err)
+		}
+	})
+}
+
+func TestMessageHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		sender := addClient(store, "sender", t)
+		if err := store.CreateChat(sender, "chat", "Chat", nil); err != nil {
+			t.Fatalf("failed to create chat: %v", err)
+		}
+		storeMessages(store, sender, "chat", []string{"1", "2", "3", "4", "5"}, t)
+
+		tests := []struct {
+			name    string
+			query   models.HistoryQuery
+			seqs    []int
+			hasMore bool
+		}{
+			{"newest page", models.HistoryQuery{Limit: 2}, []int{4, 5}, true},
+			{"before a sequence number", models.HistoryQuery{BeforeSeq: 4, Limit: 2}, []int{2, 3}, true},
+			{"last page", models.HistoryQuery{BeforeSeq: 2, Limit: 2}, []int{1}, false},
+			{"after a sequence number", models.HistoryQuery{AfterSeq: 1, Limit: 2}, []int{2, 3}, true},
+			{"closed range", models.HistoryQuery{AfterSeq: 1, BeforeSeq: 4}, []int{2, 3}, false},
+			{"before a time", models.HistoryQuery{BeforeMs: 3000}, []int{1, 2}, false},
+			{"after a time", models.HistoryQuery{AfterMs: 4000}, []int{5}, false},
+		}
+		for _, test := range tests {
+			test.query.ChatID = "chat"
+			page, err := store.RetrieveMessageHistory(test.query)
+			if err != nil {
+				t.Fatalf("%s: failed to load history: %v", test.name, err)
+			}
+			var seqs []int
+			for _, message := range page.Messages {
+				seqs = append(seqs, message.Seq)
+			}
+			if !reflect.DeepEqual(seqs, test.seqs) || page.HasMore != test.hasMore || page.LastSeq != 5 {
+				t.Fatalf("%s: expected %v with more %v, got %v with more %v and last %d", test.name, test.seqs, test.hasMore, seqs, page.HasMore, page.LastSeq)
+			}
+		}
+	})
+}
+
+func TestDeviceCursor(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		sender := addClient(store, "sender", t)
+		recipient := addClient(store, "recipient", t)
+		if err := store.CreateChat(sender, "chat", "Chat", []int{recipient}); err != nil {
+			t.Fatalf("failed to create chat: %v", err)
+		}
+		acks := storeMessages(store, sender, "chat", []string{"a", "b", "c"}, t)
+		first, second, third := acks[0].MessageID, acks[1].MessageID, acks[2].MessageID
+
+		// A later ack only records that message, the cursor waits for the gap before it
+		if err := store.AdvanceDeviceCursor(recipient, "phone", third); err != nil {
+			t.Fatalf("failed to advance cursor: %v", err)
+		}
+		cursor, err := store.GetDeviceCursor(recipient, "phone")
+		if err != nil || cursor != first-1 {
+			t.Fatalf("expected the cursor before message %d, got %d, %v", first, cursor, err)
+		}
+		undelivered, err := store.RetrieveUndeliveredMessages(recipient, "phone", cursor)
+		if err != nil || !reflect.DeepEqual(messageIDs(undelivered), []int{first, second}) {
+			t.Fatalf("expected messages %d and %d to replay, got %v, %v", first, second, messageIDs(undelivered), err)
+		}
+
+		// Closing the gaps moves the cursor past everything received
+		for _, messageID := range []int{first, second} {
+			if err := store.AdvanceDeviceCursor(recipient, "phone", messageID); err != nil {
+				t.Fatalf("failed to advance cursor: %v", err)
+			}
+		}
+		if cursor, err := store.GetDeviceCursor(recipient, "phone"); err != nil || cursor != third {
+			t.Fatalf("expected the cursor at message %d, got %d, %v", third, cursor, err)
+		}
+
+		// The sender's own messages count as delivered, yet its other devices still replay them
+		if delivered, err := store.MarkMessageDelivered(first, sender); err != nil || delivered {
+			t.Fatalf("expected the sender's delivery to be acknowledged already, got %v, %v", delivered, err)
+		}
+		if delivered, err := store.MarkMessageDelivered(first, recipient); err != nil || !delivered {
+			t.Fatalf("expected the recipient's delivery to be marked, got %v, %v", delivered, err)
+		}
+		undelivered, err = store.RetrieveUndeliveredMessages(sender, "laptop", 0)
+		if err != nil || !reflect.DeepEqual(messageIDs(undelivered), []int{first, second, third}) {
+			t.Fatalf("expected the sender's messages to replay on another device, got %v, %v", messageIDs(undelivered), err)
+		}
+	})
+}
+
+func TestInvites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		admin := addClient(store, "admin", t)
+		invite, err := store.CreateInvite("code", admin, 1, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("failed to create invite: %v", err)
+		}
+		if _, err := store.CreateInvite("expired", admin, 1, time.Now().Add(-time.Hour)); err != nil {
+			t.Fatalf("failed to create invite: %v", err)
+		}
+
+		if _, err := store.RegisterClientWithInvite("code", "admin", "salt", "", models.RoleMember); !errors.Is(err, ErrUsernameTaken) {
+			t.Fatalf("expected ErrUsernameTaken, got %v", err)
+		}
+		if _, err := store.RegisterClientWithInvite("code", "newcomer", "salt", "", models.RoleMember); err != nil {
+			t.Fatalf("expected the taken username not to use up the invite, got %v", err)
+		}
+		if _, err := store.RegisterClientWithInvite("code", "latecomer", "salt", "", models.RoleMember); !errors.Is(err, ErrInviteInvalid) {
+			t.Fatalf("expected a used up invite to be refused, got %v", err)
+		}
+		if _, err := store.RegisterClientWithInvite("expired", "latecomer", "salt", "", models.RoleMember); !errors.Is(err, ErrInviteInvalid) {
+			t.Fatalf("expected an expired invite to be refused, got %v", err)
+		}
+
+		if err := store.RevokeInvite(invite.ID); err != nil {
+			t.Fatalf("failed to revoke invite: %v", err)
+		}
+		if err := store.RevokeInvite(invite.ID + 100); !errors.Is(err, ErrInviteNotFound) {
+			t.Fatalf("expected ErrInviteNotFound, got %v", err)
+		}
+		invites, err := store.ListInvites()
+		if err != nil || len(invites) != 2 {
+			t.Fatalf("expected two invites, got %+v, %v", invites, err)
+		}
+		for _, listed := range invites {
+			if listed.Code == "code" && (!listed.Revoked || listed.Uses != 1) {
+				t.Fatalf("expected the invite to be used once and revoked, got %+v", listed)
+			}
+		}
+	})
+}
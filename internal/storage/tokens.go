@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+func (db *sqlStore) StoreRefreshToken(clientID int, tokenHash string, expiresAt time.Time) error {
+	query := `
+	INSERT INTO refresh_tokens (token_hash, client_id, expires_at)
+	VALUES ($1, $2, $3);`
+	_, err := db.Exec(query, tokenHash, clientID, expiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one and returns the client it belongs to.
+// Presenting a token that was already rotated revokes all refresh tokens of its client, because
+// either the client or an attacker holds a stolen copy.
+func (db *sqlStore) RotateRefreshToken(oldHash string, newHash string, expiresAt time.Time) (int, error) {
+	transaction, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	// Revoking the old token first makes concurrent rotations of it wait for this one
+	var clientID int
+	query := `
+	UPDATE refresh_tokens SET revoked = true
+	WHERE token_hash = $1 AND NOT revoked AND expires_at > $2
+	RETURNING client_id;`
+	err = transaction.QueryRow(query, oldHash, time.Now().Unix()).Scan(&clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		var revoked bool
+		err = transaction.QueryRow("SELECT client_id, revoked FROM refresh_tokens WHERE token_hash = $1", oldHash).Scan(&clientID, &revoked)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !revoked) {
+			return 0, ErrRefreshTokenInvalid
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up refresh token: %w", err)
+		}
+		if _, err := transaction.Exec("UPDATE refresh_tokens SET revoked = true WHERE client_id = $1", clientID); err != nil {
+			return 0, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+		if err := transaction.Commit(); err != nil {
+			return 0, err
+		}
+		return clientID, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	_, err = transaction.Exec("INSERT INTO refresh_tokens (token_hash, client_id, expires_at) VALUES ($1, $2, $3)", newHash, clientID, expiresAt.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return clientID, transaction.Commit()
+}
+
+// RevokeRefreshToken revokes one of the client's refresh tokens. It reports false if the client
+// has no such token.
+func (db *sqlStore) RevokeRefreshToken(clientID int, tokenHash string) (bool, error) {
+	result, err := db.Exec("UPDATE refresh_tokens SET revoked = true WHERE token_hash = $1 AND client_id = $2", tokenHash, clientID)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+func (db *sqlStore) RevokeAccessToken(clientID int, tokenID string, expiresAt time.Time) error {
+	query := `
+	INSERT INTO revoked_tokens (token_id, client_id, expires_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (token_id) DO NOTHING;`
+	_, err := db.Exec(query, tokenID, clientID, expiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+	return nil
+}
+
+// LoadRevokedTokens returns the revoked access tokens that have not expired yet, keyed by token ID.
+func (db *sqlStore) LoadRevokedTokens() (map[string]time.Time, error) {
+	if _, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < $1", time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("failed to purge revoked tokens: %w", err)
+	}
+	rows, err := db.Query("SELECT token_id, expires_at FROM revoked_tokens")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revoked tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := make(map[string]time.Time)
+	for rows.Next() {
+		var tokenID string
+		var expiresAt int64
+		if err := rows.Scan(&tokenID, &expiresAt); err != nil {
+			return nil, err
+		}
+		tokens[tokenID] = time.Unix(expiresAt, 0)
+	}
+	return tokens, rows.Err()
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"time"
+)
+
+// SigningKeyConfig describes one JWT signing key. HS256 keys carry their Secret inline,
+// RS256 and EdDSA keys are read from PEM files. A key without a private key only verifies
+// tokens, which is how a retired key stays valid until its tokens have expired.
+type SigningKeyConfig struct {
+	ID             string `yaml:"kid"`
+	Algorithm      string `yaml:"alg"`
+	Secret         string `yaml:"secret"`
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	PublicKeyFile  string `yaml:"publicKeyFile"`
+}
+
+// OIDCConfig describes the external identity provider users can log in with. RedirectURL is
+// this server's /oidc/callback as registered at the provider. An empty Issuer disables it.
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientId"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectUrl"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+type AuthConfig struct {
+	// AccessTokenTTL is the lifetime of access tokens, RefreshTokenTTL that of refresh tokens.
+	AccessTokenTTL  time.Duration `yaml:"accessTokenTTL"`
+	RefreshTokenTTL time.Duration `yaml:"refreshTokenTTL"`
+	// ActiveKeyID names the key new tokens are signed with
+	ActiveKeyID string             `yaml:"activeKeyId"`
+	Keys        []SigningKeyConfig `yaml:"keys"`
+	OIDC        OIDCConfig         `yaml:"oidc"`
+}
+
+// jwtSecret is the flag.Value behind JWT_SECRET, it replaces the keys with a single HS256 key.
+type jwtSecret struct{ auth *AuthConfig }
+
+func (secret jwtSecret) String() string { return "" }
+
+func (secret jwtSecret) Set(value string) error {
+	secret.auth.ActiveKeyID = "default"
+	secret.auth.Keys = []SigningKeyConfig{{ID: "default", Algorithm: "HS256", Secret: value}}
+	return nil
+}
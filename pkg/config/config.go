@@ -0,0 +1,305 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete configuration of the server. Every value has a default, which a YAML or
+// JSON file overrides, which environment variables override, which command line flags override.
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Database DatabaseConfig `yaml:"database"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	TLS      TLSConfig      `yaml:"tls"`
+}
+
+func Defaults() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port: ":8080",
+			// A zero PingInterval becomes nine tenths of PongTimeout in Load
+			PongTimeout:  60 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Driver:  DriverPostgres,
+			Path:    "chat.db",
+			Host:    "localhost",
+			Port:    5432,
+			User:    "postgres",
+			DBName:  "chat",
+			SSLMode: "disable",
+		},
+		Auth: AuthConfig{
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
+		Limits: LimitsConfig{
+			SendBufferSize:   256,
+			OverflowPolicy:   OverflowDropClient,
+			MessageClockSkew: 5 * time.Minute,
+			LoginMaxFailures: 5,
+			LoginLockout:     15 * time.Minute,
+		},
+	}
+}
+
+// setting binds one value to its environment variable and command line flag. Secrets have no
+// flag, since command lines are visible to every user of the machine.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (config *Config) settings() []setting {
+	return []setting{
+		{"port", "PORT", "address to listen on", stringValue{&config.Server.Port}},
+		{"ping-interval", "PING_INTERVAL", "how often clients are pinged", durationValue{&config.Server.PingInterval}},
+		{"pong-timeout", "PONG_TIMEOUT", "how long a client may stay silent", durationValue{&config.Server.PongTimeout}},
+		{"write-timeout", "WRITE_TIMEOUT", "how long a single write may take", durationValue{&config.Server.WriteTimeout}},
+		{"invite-secrets-file", "INVITE_SECRETS_FILE", "file with one invite code per line to seed", stringValue{&config.Server.InviteSecretsFile}},
+
+		{"db-driver", "DB_DRIVER", "postgres, sqlite or memory", stringValue{&config.Database.Driver}},
+		{"db-path", "DB_PATH", "database file of the sqlite driver", stringValue{&config.Database.Path}},
+		{"db-host", "DB_HOST", "database host", stringValue{&config.Database.Host}},
+		{"db-port", "DB_PORT", "database port", intValue{&config.Database.Port}},
+		{"db-user", "DB_USER", "database user", stringValue{&config.Database.User}},
+		{"", "DB_PASSWORD", "database password", stringValue{&config.Database.Password}},
+		{"db-name", "DB_NAME", "database name", stringValue{&config.Database.DBName}},
+		{"db-sslmode", "DB_SSLMODE", "database sslmode", stringValue{&config.Database.SSLMode}},
+
+		{"access-token-ttl", "ACCESS_TOKEN_TTL", "lifetime of access tokens", durationValue{&config.Auth.AccessTokenTTL}},
+		{"refresh-token-ttl", "REFRESH_TOKEN_TTL", "lifetime of refresh tokens", durationValue{&config.Auth.RefreshTokenTTL}},
+		{"", "JWT_SECRET", "HS256 secret replacing the configured signing keys", jwtSecret{&config.Auth}},
+		{"oidc-issuer", "OIDC_ISSUER", "OpenID Connect issuer URL", stringValue{&config.Auth.OIDC.Issuer}},
+		{"oidc-client-id", "OIDC_CLIENT_ID", "OpenID Connect client ID", stringValue{&config.Auth.OIDC.ClientID}},
+		{"", "OIDC_CLIENT_SECRET", "OpenID Connect client secret", stringValue{&config.Auth.OIDC.ClientSecret}},
+		{"oidc-redirect-url", "OIDC_REDIRECT_URL", "URL of /oidc/callback registered at the provider", stringValue{&config.Auth.OIDC.RedirectURL}},
+
+		{"send-buffer-size", "SEND_BUFFER_SIZE", "frames queued per session", intValue{&config.Limits.SendBufferSize}},
+		{"send-overflow-policy", "SEND_OVERFLOW_POLICY", "drop_client or drop_oldest", stringValue{&config.Limits.OverflowPolicy}},
+		{"message-clock-skew", "MESSAGE_CLOCK_SKEW", "accepted difference of message timestamps", durationValue{&config.Limits.MessageClockSkew}},
+		{"login-max-failures", "LOGIN_MAX_FAILURES", "failed logins that lock an account", intValue{&config.Limits.LoginMaxFailures}},
+		{"login-lockout", "LOGIN_LOCKOUT", "how long a locked account stays locked", durationValue{&config.Limits.LoginLockout}},
+
+		{"tls-cert-file", "TLS_CERT_FILE", "TLS certificate in PEM format", stringValue{&config.TLS.CertFile}},
+		{"tls-key-file", "TLS_KEY_FILE", "TLS private key in PEM format", stringValue{&config.TLS.KeyFile}},
+	}
+}
+
+func (config *Config) flagSet(configFile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("chat_server", flag.ContinueOnError)
+	flags.StringVar(configFile, "config", *configFile, "YAML or JSON configuration file (CHAT_CONFIG_FILE)")
+	for _, setting := range config.settings() {
+		if setting.flag != "" {
+			flags.Var(setting.value, setting.flag, fmt.Sprintf("%s (%s)", setting.usage, setting.env))
+		}
+	}
+	return flags
+}
+
+// Load builds the configuration from the defaults, the file named by -config or CHAT_CONFIG_FILE,
+// the environment and the command line arguments, and validates the result.
+func Load(args []string) (*Config, error) {
+	// The flags are parsed twice, first only to find the file that lies beneath them
+	configFile := os.Getenv("CHAT_CONFIG_FILE")
+	probe := Defaults().flagSet(&configFile)
+	probe.SetOutput(io.Discard)
+	if err := probe.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := Defaults()
+	if configFile != "" {
+		if err := config.loadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, setting := range config.settings() {
+		if value, ok := os.LookupEnv(setting.env); ok && value != "" {
+			if err := setting.value.Set(value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", setting.env, err)
+			}
+		}
+	}
+	if err := config.flagSet(&configFile).Parse(args); err != nil {
+		return nil, err
+	}
+	if config.Server.PingInterval == 0 {
+		config.Server.PingInterval = config.Server.PongTimeout * 9 / 10
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (config *Config) loadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	// JSON is valid YAML, so both formats go through the same decoder
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Validate reports every problem of the configuration at once.
+func (config *Config) Validate() error {
+	var problems []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(config.Server.Port)
+	check(err == nil, "server.port %q is not a host:port address", config.Server.Port)
+	check(config.Server.PongTimeout > 0, "server.pongTimeout must be positive")
+	check(config.Server.PingInterval > 0 && config.Server.PingInterval < config.Server.PongTimeout,
+		"server.pingInterval must be positive and shorter than server.pongTimeout")
+	check(config.Server.WriteTimeout > 0, "server.writeTimeout must be positive")
+
+	switch config.Database.Driver {
+	case DriverPostgres:
+		check(config.Database.Host != "", "database.host must be set")
+		check(config.Database.Port > 0 && config.Database.Port < 65536, "database.port %d is not a port", config.Database.Port)
+		check(config.Database.User != "", "database.user must be set")
+		check(config.Database.DBName != "", "database.dbname must be set")
+	case DriverSQLite:
+		check(config.Database.Path != "", "database.path must be set")
+	case DriverMemory:
+	default:
+		check(false, "database.driver %q is not postgres, sqlite or memory", config.Database.Driver)
+	}
+
+	check(config.Auth.AccessTokenTTL > 0, "auth.accessTokenTTL must be positive")
+	check(config.Auth.RefreshTokenTTL > config.Auth.AccessTokenTTL, "auth.refreshTokenTTL must be longer than auth.accessTokenTTL")
+	keyIDs := make(map[string]bool)
+	for index, key := range config.Auth.Keys {
+		check(key.ID != "" && !keyIDs[key.ID], "auth.keys[%d] needs a unique kid", index)
+		keyIDs[key.ID] = true
+		switch key.Algorithm {
+		case "HS256":
+			check(len(key.Secret) >= 32, "auth.keys[%d] needs a secret of at least 32 characters", index)
+		case "RS256", "EdDSA":
+			check(key.PrivateKeyFile != "" || key.PublicKeyFile != "", "auth.keys[%d] needs a privateKeyFile or publicKeyFile", index)
+		default:
+			check(false, "auth.keys[%d] has unsupported alg %q", index, key.Algorithm)
+		}
+	}
+	check(len(config.Auth.Keys) == 0 || keyIDs[config.Auth.ActiveKeyID], "auth.activeKeyId %q names no configured key", config.Auth.ActiveKeyID)
+	if config.Auth.OIDC.Issuer != "" {
+		check(config.Auth.OIDC.ClientID != "", "auth.oidc.clientId must be set")
+		check(config.Auth.OIDC.RedirectURL != "", "auth.oidc.redirectUrl must be set")
+	}
+
+	check(config.Limits.SendBufferSize > 0, "limits.sendBufferSize must be positive")
+	check(config.Limits.OverflowPolicy == OverflowDropClient || config.Limits.OverflowPolicy == OverflowDropOldest,
+		"limits.overflowPolicy must be %s or %s", OverflowDropClient, OverflowDropOldest)
+	check(config.Limits.MessageClockSkew > 0, "limits.messageClockSkew must be positive")
+	check(config.Limits.LoginMaxFailures > 0, "limits.loginMaxFailures must be positive")
+	check(config.Limits.LoginLockout > 0, "limits.loginLockout must be positive")
+
+	check((config.TLS.CertFile == "") == (config.TLS.KeyFile == ""), "tls.certFile and tls.keyFile must be set together")
+	for _, file := range []string{config.TLS.CertFile, config.TLS.KeyFile} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "tls file %s is not readable", file)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+const redacted = "<redacted>"
+
+// Redacted renders the configuration as YAML with every secret replaced.
+func (config Config) Redacted() string {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	redact(&config.Database.Password)
+	redact(&config.Auth.OIDC.ClientSecret)
+	config.Auth.Keys = append([]SigningKeyConfig(nil), config.Auth.Keys...)
+	for index := range config.Auth.Keys {
+		redact(&config.Auth.Keys[index].Secret)
+	}
+	output, err := yaml.Marshal(config)
+	if err != nil {
+		return err.Error()
+	}
+	return string(output)
+}
+
+type stringValue struct{ target *string }
+
+func (value stringValue) String() string {
+	if value.target == nil {
+		return ""
+	}
+	return *value.target
+}
+
+func (value stringValue) Set(text string) error {
+	*value.target = text
+	return nil
+}
+
+type intValue struct{ target *int }
+
+func (value intValue) String() string {
+	if value.target == nil {
+		return "0"
+	}
+	return strconv.Itoa(*value.target)
+}
+
+func (value intValue) Set(text string) error {
+	parsed, err := strconv.Atoi(text)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", text)
+	}
+	*value.target = parsed
+	return nil
+}
+
+type durationValue struct{ target *time.Duration }
+
+func (value durationValue) String() string {
+	if value.target == nil {
+		return "0s"
+	}
+	return value.target.String()
+}
+
+func (value durationValue) Set(text string) error {
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration like 30s or 15m", text)
+	}
+	*value.target = parsed
+	return nil
+}
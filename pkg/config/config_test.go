@@ -0,0 +1,153 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnvironment unsets every variable Load reads, an empty value counts as unset.
+func clearEnvironment(t *testing.T) {
+	t.Setenv("CHAT_CONFIG_FILE", "")
+	for _, setting := range Defaults().settings() {
+		t.Setenv(setting.env, "")
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return filename
+}
+
+const fileSettings = `
+server:
+  port: ":9000"
+auth:
+  accessTokenTTL: 10m
+limits:
+  loginMaxFailures: 3
+`
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		args   []string
+		check  func(*Config) interface{}
+		expect interface{}
+	}{
+		{"default", "", nil, nil, func(c *Config) interface{} { return c.Server.Port }, ":8080"},
+		{"file over default", fileSettings, nil, nil, func(c *Config) interface{} { return c.Server.Port }, ":9000"},
+		{"environment over file", fileSettings, map[string]string{"PORT": ":9100"}, nil,
+			func(c *Config) interface{} { return c.Server.Port }, ":9100"},
+		{"flag over environment", fileSettings, map[string]string{"PORT": ":9100"}, []string{"-port", ":9200"},
+			func(c *Config) interface{} { return c.Server.Port }, ":9200"},
+		{"duration from file", fileSettings, nil, nil, func(c *Config) interface{} { return c.Auth.AccessTokenTTL }, 10 * time.Minute},
+		{"duration from environment", fileSettings, map[string]string{"ACCESS_TOKEN_TTL": "5m"}, nil,
+			func(c *Config) interface{} { return c.Auth.AccessTokenTTL }, 5 * time.Minute},
+		{"duration from flag", fileSettings, map[string]string{"ACCESS_TOKEN_TTL": "5m"}, []string{"-access-token-ttl", "2m"},
+			func(c *Config) interface{} { return c.Auth.AccessTokenTTL }, 2 * time.Minute},
+		{"number from environment", fileSettings, map[string]string{"LOGIN_MAX_FAILURES": "7"}, nil,
+			func(c *Config) interface{} { return c.Limits.LoginMaxFailures }, 7},
+		{"values the file leaves out keep their default", fileSettings, nil, nil,
+			func(c *Config) interface{} { return c.Limits.LoginLockout }, 15 * time.Minute},
+		{"ping interval follows the pong timeout", "", map[string]string{"PONG_TIMEOUT": "10s"}, nil,
+			func(c *Config) interface{} { return c.Server.PingInterval }, 9 * time.Second},
+		{"JWT_SECRET replaces the keys", "", map[string]string{"JWT_SECRET": strings.Repeat("s", 32)}, nil,
+			func(c *Config) interface{} { return c.Auth.ActiveKeyID + " " + c.Auth.Keys[0].Algorithm }, "default HS256"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnvironment(t)
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"-config", writeFile(t, test.file)}, args...)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config, err := Load(args)
+			if err != nil {
+				t.Fatalf("failed to load configuration: %v", err)
+			}
+			if value := test.check(config); value != test.expect {
+				t.Fatalf("expected %v, got %v", test.expect, value)
+			}
+		})
+	}
+}
+
+func TestConfigFileLocation(t *testing.T) {
+	clearEnvironment(t)
+	fromEnvironment := writeFile(t, "server:\n  port: \":9300\"\n")
+	fromFlag := writeFile(t, "server:\n  port: \":9400\"\n")
+	t.Setenv("CHAT_CONFIG_FILE", fromEnvironment)
+
+	config, err := Load(nil)
+	if err != nil || config.Server.Port != ":9300" {
+		t.Fatalf("expected the file named by CHAT_CONFIG_FILE, got %+v, %v", config, err)
+	}
+	config, err = Load([]string{"-config", fromFlag})
+	if err != nil || config.Server.Port != ":9400" {
+		t.Fatalf("expected the file named by -config, got %+v, %v", config, err)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		problem string
+	}{
+		{"malformed duration", "", map[string]string{"PONG_TIMEOUT": "soon"}, nil, "invalid PONG_TIMEOUT"},
+		{"malformed number", "", nil, []string{"-db-port", "many"}, "not a number"},
+		{"unknown file field", "server:\n  prot: \":9000\"\n", nil, nil, "failed to parse config file"},
+		{"missing file", "", map[string]string{"CHAT_CONFIG_FILE": "/nonexistent/config.yaml"}, nil, "failed to read config file"},
+		{"port without colon", "", map[string]string{"PORT": "8080"}, nil, "server.port"},
+		{"ping interval not below pong timeout", "", nil, []string{"-ping-interval", "2m", "-pong-timeout", "1m"}, "server.pingInterval"},
+		{"unknown driver", "", map[string]string{"DB_DRIVER": "mysql"}, nil, "database.driver"},
+		{"sqlite without path", "database:\n  driver: sqlite\n  path: \"\"\n", nil, nil, "database.path"},
+		{"refresh tokens shorter than access tokens", "", map[string]string{"REFRESH_TOKEN_TTL": "1m"}, nil, "auth.refreshTokenTTL"},
+		{"short JWT secret", "", map[string]string{"JWT_SECRET": "short"}, nil, "auth.keys[0] needs a secret"},
+		{"active key not configured", "auth:\n  activeKeyId: other\n  keys:\n    - kid: main\n      alg: HS256\n      secret: " +
+			strings.Repeat("s", 32) + "\n", nil, nil, "auth.activeKeyId"},
+		{"unknown overflow policy", "", nil, []string{"-send-overflow-policy", "drop_all"}, "limits.overflowPolicy"},
+		{"zero send buffer", "", map[string]string{"SEND_BUFFER_SIZE": "0"}, nil, "limits.sendBufferSize"},
+		{"TLS certificate without key", "", map[string]string{"TLS_CERT_FILE": "cert.pem"}, nil, "tls.certFile and tls.keyFile"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnvironment(t)
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"-config", writeFile(t, test.file)}, args...)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Fatalf("expected an error about %q, got %v", test.problem, err)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := Defaults()
+	config.Server.PingInterval = time.Second
+	config.Server.Port = "nowhere"
+	config.Limits.LoginMaxFailures = 0
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "server.port") || !strings.Contains(err.Error(), "limits.loginMaxFailures") {
+		t.Fatalf("expected both problems to be reported, got %v", err)
+	}
+}
@@ -1,42 +1,29 @@
 package config
 
 import (
-	"encoding/json"
-	"log"
-	"os"
+	"fmt"
+)
+
+// Database drivers, postgres needs a running server while sqlite keeps everything in one file and
+// memory loses everything when the server stops.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverMemory   = "memory"
 )
 
 type DatabaseConfig struct {
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	User     string `json:"user"`
-	Password string `json:"password"`
-	DBName   string `json:"dbname"`
+	Driver   string `yaml:"driver"`
+	Path     string `yaml:"path"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	DBName   string `yaml:"dbname"`
+	SSLMode  string `yaml:"sslmode"`
 }
 
-func LoadDataBaseConfig() (*DatabaseConfig, error) {
-
-	envVariable := os.Getenv("APP_ENV")
-	var filePath string
-	switch envVariable {
-	case "test":
-		filePath = "/home/andreas/Documents/database_access/postgres_test_config.json"
-	default:
-		filePath = "/home/andreas/Documents/database_access/postgres_config.json"
-	}
-
-	var config DatabaseConfig
-	configFile, err := os.Open(filePath)
-	if err != nil {
-		log.Printf("Error opening config file: %v", err)
-		return nil, err
-	}
-	defer configFile.Close()
-	jsonParser := json.NewDecoder(configFile)
-	err = jsonParser.Decode(&config)
-	if err != nil {
-		log.Printf("Error parsing config file: %v", err)
-		return nil, err
-	}
-	return &config, err
+func (database DatabaseConfig) ConnectionString() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		database.Host, database.Port, database.User, database.Password, database.DBName, database.SSLMode)
 }
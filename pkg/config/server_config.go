@@ -1,17 +1,44 @@
 package config
 
 import (
-	"os"
+	"time"
+)
+
+const (
+	// OverflowDropClient disconnects a client whose send queue is full.
+	OverflowDropClient = "drop_client"
+	// OverflowDropOldest discards the oldest queued frame to make room for the new one.
+	OverflowDropOldest = "drop_oldest"
 )
 
 type ServerConfig struct {
-	Port string
+	Port string `yaml:"port"`
+	// PingInterval is how often the server pings each client, PongTimeout how long a client may
+	// stay silent before it is considered dead, WriteTimeout how long a single write may take.
+	PingInterval time.Duration `yaml:"pingInterval"`
+	PongTimeout  time.Duration `yaml:"pongTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// InviteSecretsFile seeds single-use invites.
+	InviteSecretsFile string `yaml:"inviteSecretsFile"`
+}
+
+// LimitsConfig bounds what a single client can make the server do.
+type LimitsConfig struct {
+	SendBufferSize int    `yaml:"sendBufferSize"`
+	OverflowPolicy string `yaml:"overflowPolicy"`
+	// MessageClockSkew is how far a message's timestamp may be from the server's clock.
+	MessageClockSkew time.Duration `yaml:"messageClockSkew"`
+	// LoginMaxFailures failed logins in a row lock an account for LoginLockout.
+	LoginMaxFailures int           `yaml:"loginMaxFailures"`
+	LoginLockout     time.Duration `yaml:"loginLockout"`
+}
+
+// TLSConfig enables HTTPS and WSS when both files are set.
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
 }
 
-func LoadServerConfig() *ServerConfig {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = ":8080"
-	}
-	return &ServerConfig{Port: port}
+func (tls TLSConfig) Enabled() bool {
+	return tls.CertFile != "" && tls.KeyFile != ""
 }
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+)
+
+type ChatMembersResponse struct {
+	Members []struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	} `json:"members"`
+}
+
+func chatURL(chatID, action string) string {
+	return fmt.Sprintf("http://localhost:8080/chats/%s/%s", chatID, action)
+}
+
+func expectStatus(resp *http.Response, expected int, t *testing.T) {
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		t.Fatalf("%s %s returned status code %d, expected %d", resp.Request.Method, resp.Request.URL, resp.StatusCode, expected)
+	}
+}
+
+// chatMemberCount returns how many members the chat lists for the client.
+func chatMemberCount(token, chatID string, t *testing.T) int {
+	resp := authorizedRequest(http.MethodGet, chatURL(chatID, "members"), token, nil, t)
+	var membersResponse ChatMembersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&membersResponse); err != nil {
+		t.Fatalf("failed to decode members: %v", err)
+	}
+	expectStatus(resp, http.StatusOK, t)
+	return len(membersResponse.Members)
+}
+
+func TestCreateChatInvitesMembers(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET28")
+	secret2 := os.Getenv("CHAT_SERVER_SECRET29")
+	if secret == "" || secret2 == "" {
+		t.Fatalf("environment variables CHAT_SERVER_SECRET28 and CHAT_SERVER_SECRET29 must be set")
+	}
+	owner, err := registerClient(secret, "CreatingOwner", t)
+	if err != nil {
+		t.Fatalf("failed to register owner: %v", err)
+	}
+	guest, err := registerClient(secret2, "ListedGuest", t)
+	if err != nil {
+		t.Fatalf("failed to register guest: %v", err)
+	}
+	chatID := fmt.Sprintf("listed-%d", owner.ID)
+	request := func(members ...int) interface{} {
+		return struct {
+			ChatID  string `json:"chatId"`
+			Members []int  `json:"members"`
+		}{ChatID: chatID, Members: members}
+	}
+
+	// An unknown member is a bad request, and the chat is not created
+	expectStatus(authorizedRequest(http.MethodPost, "http://localhost:8080/chats", owner.Token, request(guest.ID, guest.ID+100000), t),
+		http.StatusBadRequest, t)
+
+	// Listed members are invited, they become members by joining
+	expectStatus(authorizedRequest(http.MethodPost, "http://localhost:8080/chats", owner.Token, request(guest.ID), t), http.StatusOK, t)
+	if count := chatMemberCount(owner.Token, chatID, t); count != 1 {
+		t.Fatalf("expected only the owner to be a member before joining, got %d members", count)
+	}
+	expectStatus(authorizedRequest(http.MethodPost, chatURL(chatID, "join"), guest.Token, nil, t), http.StatusNoContent, t)
+	if count := chatMemberCount(owner.Token, chatID, t); count != 2 {
+		t.Fatalf("expected 2 members after joining, got %d", count)
+	}
+}
+
+func TestChatRoomMembership(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET5")
+	secret2 := os.Getenv("CHAT_SERVER_SECRET6")
+	if secret == "" || secret2 == "" {
+		t.Fatalf("environment variables CHAT_SERVER_SECRET5 and CHAT_SERVER_SECRET6 must be set")
+	}
+
+	owner, err := registerClient(secret, "RoomOwner", t)
+	if err != nil {
+		t.Fatalf("failed to register owner: %v", err)
+	}
+	guest, err := registerClient(secret2, "RoomGuest", t)
+	if err != nil {
+		t.Fatalf("failed to register guest: %v", err)
+	}
+
+	chatID := fmt.Sprintf("room-%d", owner.ID)
+	createChat(owner.Token, chatID, nil, t)
+
+	// Joining without an invitation is refused
+	expectStatus(authorizedRequest(http.MethodPost, chatURL(chatID, "join"), guest.Token, nil, t), http.StatusForbidden, t)
+
+	invitation := struct {
+		Username string `json:"username"`
+	}{Username: guest.Username}
+	expectStatus(authorizedRequest(http.MethodPost, chatURL(chatID, "invite"), owner.Token, invitation, t), http.StatusNoContent, t)
+	expectStatus(authorizedRequest(http.MethodPost, chatURL(chatID, "join"), guest.Token, nil, t), http.StatusNoContent, t)
+
+	if count := chatMemberCount(guest.Token, chatID, t); count != 2 {
+		t.Fatalf("expected 2 members, got %d", count)
+	}
+
+	// Messages from the guest reach the owner while the guest is a member
+	ownerConn := connectWebSocket(owner.Token, t)
+	defer disconnectWebSocket(ownerConn, t)
+	guestConn := connectWebSocket(guest.Token, t)
+	defer disconnectWebSocket(guestConn, t)
+
+	sendMessage(guest.ID, guestConn, chatID, "Hello room", guest.Salt, t)
+	if ack := readAcknowledgment(guestConn, t); ack.Type != "ack" {
+		t.Fatalf("guest received unexpected acknowledgment: %+v", ack)
+	}
+	if msg := readMessage(ownerConn, t); msg.Text != "Hello room" {
+		t.Fatalf("owner received incorrect message: %s", msg.Text)
+	}
+
+	// The message shows up in the room's history
+	resp := authorizedRequest(http.MethodGet, chatURL(chatID, "messages?limit=10"), owner.Token, nil, t)
+	var history struct {
+		Messages []Message `json:"messages"`
+		HasMore  bool      `json:"hasMore"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	expectStatus(resp, http.StatusOK, t)
+	if len(history.Messages) != 1 || history.Messages[0].Text != "Hello room" || history.HasMore {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+
+	// After leaving, the guest can no longer send to the room
+	expectStatus(authorizedRequest(http.MethodPost, chatURL(chatID, "leave"), guest.Token, nil, t), http.StatusNoContent, t)
+	sendMessage(guest.ID, guestConn, chatID, "Still here?", guest.Salt, t)
+	if ack := readAcknowledgment(guestConn, t); ack.Type != "error" || ack.Code != "not_member" {
+		t.Fatalf("guest expected a rejection, got: %+v", ack)
+	}
+	expectStatus(authorizedRequest(http.MethodGet, chatURL(chatID, "members"), guest.Token, nil, t), http.StatusForbidden, t)
+}
+
+type HistoryPage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"hasMore"`
+}
+
+func fetchHistory(token, chatID, parameters string, t *testing.T) HistoryPage {
+	resp := authorizedRequest(http.MethodGet, chatURL(chatID, "messages?"+parameters), token, nil, t)
+	var page HistoryPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	expectStatus(resp, http.StatusOK, t)
+	return page
+}
+
+func TestHistoryPagination(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET20")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET20 must be set")
+	}
+	client, err := registerClient(secret, "HistoryReader", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+	chatID := fmt.Sprintf("history-%d", client.ID)
+	createChat(client.Token, chatID, nil, t)
+	var sent []int
+	for i := 1; i <= 5; i++ {
+		sent = append(sent, sendAndConfirm(client, chatID, fmt.Sprintf("message %d", i), t))
+	}
+
+	// Walking back from the newest page with the oldest ID of each page returns every message once
+	var walked []int
+	parameters := "limit=2"
+	for pages := 1; ; pages++ {
+		page := fetchHistory(client.Token, chatID, parameters, t)
+		if len(page.Messages) == 0 || pages > len(sent) {
+			t.Fatalf("unexpected page %d: %+v", pages, page)
+		}
+		var ids []int
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.ID)
+		}
+		walked = append(ids, walked...)
+		if !page.HasMore {
+			break
+		}
+		parameters = fmt.Sprintf("limit=2&before=%d", ids[0])
+	}
+	if fmt.Sprint(walked) != fmt.Sprint(sent) {
+		t.Fatalf("expected messages %v, walked %v", sent, walked)
+	}
+
+	// Timestamp bounds are camelCase like the WebSocket request
+	if page := fetchHistory(client.Token, chatID, "beforeMs=1", t); len(page.Messages) != 0 {
+		t.Fatalf("expected no messages before the epoch, got %+v", page)
+	}
+	expectStatus(authorizedRequest(http.MethodGet, chatURL(chatID, "messages?afterMs=x"), client.Token, nil, t), http.StatusBadRequest, t)
+}
@@ -37,15 +37,13 @@ func checkPresence(clientID int, t *testing.T) (*PresenceResponse, error) {
 }
 
 func TestCheckPresence(t *testing.T) {
-	secret := os.Getenv("CHAT_SERVER_SECRET")
-	username := os.Getenv("CHAT_SERVER_USERNAME")
-
-	if secret == "" || username == "" {
-		t.Fatalf("environment variables CHAT_SERVER_SECRET and CHAT_SERVER_USERNAME must be set")
+	secret := os.Getenv("CHAT_SERVER_SECRET26")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET26 must be set")
 	}
 
 	// Register a client
-	registerResponse, err := registerClient(secret, username, t)
+	registerResponse, err := registerClient(secret, "PresenceClient", t)
 	if err != nil {
 		t.Fatalf("failed to register client: %v", err)
 	}
@@ -74,16 +72,7 @@ func TestCheckPresence(t *testing.T) {
 		t.Fatalf("unexpected presence status: %v", presenceResponse.Status)
 	}
 
-	// Disconnect the WebSocket
-	disconnectWebSocket(connection, t)
+	// Disconnect the WebSocket, the server notices it once the connection's read loop ends
+	disconnectWebSocketWait(clientID, connection, t)
 	t.Log("Disconnected from WebSocket")
-
-	// Check presence again (should be not present after disconnection)
-	presenceResponse, err = checkPresence(clientID, t)
-	if err != nil {
-		t.Fatalf("failed to check presence: %v", err)
-	}
-	if presenceResponse.Status != "not_present" {
-		t.Fatalf("unexpected presence status: %v", presenceResponse.Status)
-	}
 }
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
 	"github.com/gorilla/websocket"
 	"net/http"
 	"os"
@@ -18,17 +18,21 @@ type RegisterRequest struct {
 }
 
 type RegisterResponse struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Token    string `json:"token"`
-	Salt     string `json:"salt"`
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	Salt         string `json:"salt"`
 }
 
 type Message struct {
+	ID          int    `json:"id,omitempty"`
 	ClientID    int    `json:"clientId"`
+	ChatID      string `json:"chatId,omitempty"`
 	Text        string `json:"text"`
 	TimestampMs int64  `json:"timestamp_ms"`
 	Hash        string `json:"hash"`
+	Seq         int    `json:"seq"`
 }
 
 func registerClient(secret, username string, t *testing.T) (*RegisterResponse, error) {
@@ -58,12 +62,48 @@ func registerClient(secret, username string, t *testing.T) (*RegisterResponse, e
 	return &registerResponse, nil
 }
 
-func connectWebSocket(token string, t *testing.T) *websocket.Conn {
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+const protocolVersion = "chat.v1"
+
+func dialWebSocket(token, device string) (*websocket.Conn, error) {
 	headers := http.Header{}
 	headers.Add("Authorization", "Bearer "+token)
 	url := "ws://localhost:8080/ws"
+	if device != "" {
+		url += "?device=" + device
+	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocolVersion}
+	conn, _, err := dialer.Dial(url, headers)
+	return conn, err
+}
+
+func writeFrame(conn *websocket.Conn, frameType, id string, payload interface{}, t *testing.T) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+	if err := conn.WriteJSON(Envelope{Type: frameType, ID: id, Payload: payloadBytes}); err != nil {
+		t.Fatalf("failed to send %s frame: %v", frameType, err)
+	}
+}
+
+func readFrame(conn *websocket.Conn, t *testing.T) Envelope {
+	var envelope Envelope
+	if err := conn.ReadJSON(&envelope); err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	return envelope
+}
+
+func connectWebSocket(token string, t *testing.T) *websocket.Conn {
+	conn, err := dialWebSocket(token, "")
 	if err != nil {
 		t.Fatalf("failed to connect to WebSocket: %v", err)
 	}
@@ -71,11 +111,7 @@ func connectWebSocket(token string, t *testing.T) *websocket.Conn {
 }
 
 func connectWebSocketWait(clientID int, token string, t *testing.T) *websocket.Conn {
-	headers := http.Header{}
-	headers.Add("Authorization", "Bearer "+token)
-	url := "ws://localhost:8080/ws"
-
-	conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	conn, err := dialWebSocket(token, "")
 	if err != nil {
 		t.Fatalf("failed to connect to WebSocket: %v", err)
 	}
@@ -102,14 +138,27 @@ func disconnectWebSocket(conn *websocket.Conn, t *testing.T) {
 	}
 }
 
-func TestClient(t *testing.T) {
-	secret := os.Getenv("CHAT_SERVER_SECRET")
-	username := os.Getenv("CHAT_SERVER_USERNAME")
+// disconnectWebSocketWait closes the connection and waits until the server no longer reports the client present.
+func disconnectWebSocketWait(clientID int, conn *websocket.Conn, t *testing.T) {
+	disconnectWebSocket(conn, t)
 
-	if secret == "" || username == "" {
-		t.Fatalf("environment variables CHAT_SERVER_SECRET and CHAT_SERVER_USERNAME must be set")
+	timeout := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(timeout) {
+		presenceResponse, err := checkPresence(clientID, t)
+		if err == nil && presenceResponse.Status == "not_present" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	registerResponse, err := registerClient(secret, username, t)
+	t.Fatalf("WebSocket connection closed but still reported present after timeout.")
+}
+
+func TestClient(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET27")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET27 must be set")
+	}
+	registerResponse, err := registerClient(secret, "SingleClient", t)
 	if err != nil {
 		t.Fatalf("failed to register client: %v", err)
 	}
@@ -121,31 +170,17 @@ func TestClient(t *testing.T) {
 	// Send a test message
 	message := "Hello, Server!"
 
-	hash := authentication.GenerateHash(message, registerResponse.Salt)
-	msg := Message{
-		ClientID:    registerResponse.ID,
-		Text:        message,
-		TimestampMs: 0,
-		Hash:        hash,
-	}
+	msg := signedMessage(models.Message{ClientID: registerResponse.ID, Text: message}, registerResponse.Salt)
 	t.Log("Client ID", msg.ClientID)
-	msgBytes, err := json.Marshal(msg)
-
-	if err != nil {
-		t.Fatalf("failed to marshal message: %v", err)
-	}
-	err = conn.WriteMessage(websocket.TextMessage, msgBytes)
-	if err != nil {
-		t.Fatalf("failed to send message: %v", err)
-	}
+	writeFrame(conn, "message", "first", msg, t)
 
 	// Read acknowledgment
-	_, response, err := conn.ReadMessage()
-	if err != nil {
-		t.Fatalf("failed to read message: %v", err)
+	response := readFrame(conn, t)
+	if response.Type != "ack" || response.ID != "first" {
+		t.Fatalf("unexpected acknowledgment: %+v", response)
 	}
 
-	t.Logf("Received acknowledgment from server: %s\n", response)
+	t.Logf("Received acknowledgment from server: %s\n", response.Payload)
 
 	// Disconnect the WebSocket
 	disconnectWebSocket(conn, t)
@@ -157,29 +192,16 @@ func TestClient(t *testing.T) {
 
 	// Send another test message
 	message = "Hello again, Server!"
-	hash = authentication.GenerateHash(message, registerResponse.Salt)
-	msg = Message{
-		ClientID:    registerResponse.ID,
-		Text:        message,
-		TimestampMs: 0,
-		Hash:        hash,
-	}
-	msgBytes, err = json.Marshal(msg)
-	if err != nil {
-		t.Fatalf("failed to marshal message: %v", err)
-	}
-	err = conn.WriteMessage(websocket.TextMessage, msgBytes)
-	if err != nil {
-		t.Fatalf("failed to send message: %v", err)
-	}
+	msg = signedMessage(models.Message{ClientID: registerResponse.ID, Text: message}, registerResponse.Salt)
+	writeFrame(conn, "message", "second", msg, t)
 
 	// Read acknowledgment
-	_, response, err = conn.ReadMessage()
-	if err != nil {
-		t.Fatalf("failed to read message: %v", err)
+	response = readFrame(conn, t)
+	if response.Type != "ack" || response.ID != "second" {
+		t.Fatalf("unexpected acknowledgment: %+v", response)
 	}
 
-	t.Logf("Received acknowledgment from server: %s\n", response)
+	t.Logf("Received acknowledgment from server: %s\n", response.Payload)
 
 	// Disconnect the WebSocket again
 	disconnectWebSocket(conn, t)
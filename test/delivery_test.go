@@ -0,0 +1,130 @@
+package test
+
+import (
+	"fmt"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/gorilla/websocket"
+	"os"
+	"testing"
+	"time"
+)
+
+// expectNoFrame fails if a frame arrives within the wait. The connection cannot be read from afterwards.
+func expectNoFrame(conn *websocket.Conn, wait time.Duration, t *testing.T) {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	var envelope Envelope
+	err := conn.ReadJSON(&envelope)
+	if err == nil {
+		t.Fatalf("expected no frame, got %s: %s", envelope.Type, envelope.Payload)
+	}
+	if netErr, ok := err.(interface{ Timeout() bool }); !ok || !netErr.Timeout() {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+}
+
+func TestOfflineRecipientReceivesMessageOnce(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET18")
+	secret2 := os.Getenv("CHAT_SERVER_SECRET19")
+	if secret == "" || secret2 == "" {
+		t.Fatalf("environment variables CHAT_SERVER_SECRET18 and CHAT_SERVER_SECRET19 must be set")
+	}
+	sender, err := registerClient(secret, "OfflineSender", t)
+	if err != nil {
+		t.Fatalf("failed to register sender: %v", err)
+	}
+	recipient, err := registerClient(secret2, "OfflineRecipient", t)
+	if err != nil {
+		t.Fatalf("failed to register recipient: %v", err)
+	}
+	chatID := fmt.Sprintf("offline-%d-%d", sender.ID, recipient.ID)
+	createChat(sender.Token, chatID, []*RegisterResponse{recipient}, t)
+
+	// The message is stored while the recipient has no session
+	senderConn := connectWebSocket(sender.Token, t)
+	defer disconnectWebSocket(senderConn, t)
+	sendMessage(sender.ID, senderConn, chatID, "Read this later", sender.Salt, t)
+	ack := readAcknowledgment(senderConn, t)
+	if ack.Type != "ack" {
+		t.Fatalf("sender received unexpected acknowledgment: %+v", ack)
+	}
+
+	// Connecting replays it, and neither the outbox nor the replay sends it a second time
+	recipientConn := connectWebSocket(recipient.Token, t)
+	msg := readMessage(recipientConn, t)
+	if msg.ID != ack.MessageID || msg.Text != "Read this later" {
+		t.Fatalf("recipient received unexpected message: %+v", msg)
+	}
+	sendDeliveryAck(recipientConn, msg.ID, t)
+	expectNoFrame(recipientConn, 1500*time.Millisecond, t)
+	disconnectWebSocket(recipientConn, t)
+
+	// Once acknowledged, the message is not replayed on the next connect
+	recipientConn = connectWebSocket(recipient.Token, t)
+	defer disconnectWebSocket(recipientConn, t)
+	expectNoFrame(recipientConn, 500*time.Millisecond, t)
+}
+
+// expectOutboxEmpty waits for the delivery worker to complete every outbox entry.
+func expectOutboxEmpty(t *testing.T) {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		pending, err := database.PendingOutbox(100)
+		if err != nil {
+			t.Fatalf("failed to read outbox: %v", err)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the outbox to be empty, %d entries are pending", len(pending))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestOutboxIsDrained(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET24")
+	secret2 := os.Getenv("CHAT_SERVER_SECRET25")
+	if secret == "" || secret2 == "" {
+		t.Fatalf("environment variables CHAT_SERVER_SECRET24 and CHAT_SERVER_SECRET25 must be set")
+	}
+	sender, err := registerClient(secret, "OutboxSender", t)
+	if err != nil {
+		t.Fatalf("failed to register sender: %v", err)
+	}
+	recipient, err := registerClient(secret2, "OutboxRecipient", t)
+	if err != nil {
+		t.Fatalf("failed to register recipient: %v", err)
+	}
+	chatID := fmt.Sprintf("outbox-%d-%d", sender.ID, recipient.ID)
+	createChat(sender.Token, chatID, []*RegisterResponse{recipient}, t)
+
+	recipientConn := connectWebSocket(recipient.Token, t)
+	defer disconnectWebSocket(recipientConn, t)
+	senderConn := connectWebSocket(sender.Token, t)
+	defer disconnectWebSocket(senderConn, t)
+
+	// A delivered message leaves no outbox entry behind
+	sendMessage(sender.ID, senderConn, chatID, "Delivered live", sender.Salt, t)
+	ack := readAcknowledgment(senderConn, t)
+	if msg := readMessage(recipientConn, t); msg.ID != ack.MessageID {
+		t.Fatalf("recipient received unexpected message: %+v", msg)
+	}
+	expectOutboxEmpty(t)
+
+	// A message stored without waking the worker is what a server that stopped before its fan-out
+	// leaves behind, the worker's next poll delivers it
+	stored, err := database.StoreMessage(models.Message{ClientID: sender.ID, ChatID: chatID, Text: "Left behind",
+		Timestamp_ms: time.Now().UnixMilli()}, "stopped-session")
+	if err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	for _, conn := range []*websocket.Conn{recipientConn, senderConn} {
+		msg := readMessage(conn, t)
+		if msg.ID != stored.MessageID || msg.Text != "Left behind" {
+			t.Fatalf("expected the stored message, got %+v", msg)
+		}
+	}
+	expectOutboxEmpty(t)
+	expectNoFrame(recipientConn, 1500*time.Millisecond, t)
+}
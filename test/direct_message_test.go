@@ -0,0 +1,72 @@
+package test
+
+import (
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func sendDirectMessage(clientID int, conn *websocket.Conn, recipient, text, salt string, t *testing.T) {
+	msg := signedMessage(models.Message{ClientID: clientID, Recipient: recipient, Text: text}, salt)
+	writeFrame(conn, "message", text, msg, t)
+}
+
+func TestDirectMessageToOfflineRecipient(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET3")
+	secret2 := os.Getenv("CHAT_SERVER_SECRET4")
+	if secret == "" || secret2 == "" {
+		t.Fatalf("environment variables CHAT_SERVER_SECRET3 and CHAT_SERVER_SECRET4 must be set")
+	}
+
+	senderResponse, err := registerClient(secret, "DirectSender", t)
+	if err != nil {
+		t.Fatalf("failed to register sender: %v", err)
+	}
+	recipientResponse, err := registerClient(secret2, "DirectRecipient", t)
+	if err != nil {
+		t.Fatalf("failed to register recipient: %v", err)
+	}
+
+	// The sender writes to the recipient by username while the recipient is offline
+	senderConn := connectWebSocket(senderResponse.Token, t)
+	defer disconnectWebSocket(senderConn, t)
+	sendDirectMessage(senderResponse.ID, senderConn, recipientResponse.Username, "Hello in private", senderResponse.Salt, t)
+	ack := readAcknowledgment(senderConn, t)
+	if ack.Type != "ack" {
+		t.Fatalf("sender received unexpected acknowledgment: %+v", ack)
+	}
+
+	// The recipient connects and receives the queued message
+	recipientConn := connectWebSocket(recipientResponse.Token, t)
+	defer disconnectWebSocket(recipientConn, t)
+	msg := readMessage(recipientConn, t)
+	if msg.Text != "Hello in private" {
+		t.Fatalf("recipient received incorrect message: %s", msg.Text)
+	}
+	if msg.ClientID != senderResponse.ID {
+		t.Fatalf("recipient received message from unexpected client: %d", msg.ClientID)
+	}
+	if msg.ID != ack.MessageID {
+		t.Fatalf("recipient received message %d, sender was told %d", msg.ID, ack.MessageID)
+	}
+	sendDeliveryAck(recipientConn, msg.ID, t)
+}
+
+func TestDirectChatIDsAreReserved(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET17")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET17 must be set")
+	}
+	squatter, err := registerClient(secret, "ChatSquatter", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+
+	// Taking the ID of the direct chat between two other clients would route their messages to the squatter
+	for _, chatID := range []string{"dm-1-2", "self-1"} {
+		reqBody := map[string]interface{}{"chatId": chatID, "members": []int{squatter.ID}}
+		expectStatus(authorizedRequest(http.MethodPost, "http://localhost:8080/chats", squatter.Token, reqBody, t), http.StatusBadRequest, t)
+	}
+}
@@ -0,0 +1,56 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestResentMessageIsStoredOnce(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET15")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET15 must be set")
+	}
+	registerResponse, err := registerClient(secret, "IdempotentSender", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+	conn := connectWebSocket(registerResponse.Token, t)
+
+	message := models.Message{ClientID: registerResponse.ID, Text: "exactly once", IdempotencyKey: "send-1"}
+	msg := signedMessage(message, registerResponse.Salt)
+	writeFrame(conn, "message", "original", msg, t)
+	original := readAcknowledgment(conn, t)
+	if original.Type != "ack" {
+		t.Fatalf("expected the original message to be accepted, got %+v", original)
+	}
+
+	// The identical frame carries a known key, so it is answered instead of rejected as a replay
+	writeFrame(conn, "message", "resent", msg, t)
+	if ack := readAcknowledgment(conn, t); ack.Type != "ack" || ack.MessageID != original.MessageID || ack.TimestampMs != original.TimestampMs {
+		t.Fatalf("expected the original acknowledgment %+v, got %+v", original, ack)
+	}
+	disconnectWebSocket(conn, t)
+
+	// After reconnecting the client signs the message again with a new nonce
+	conn = connectWebSocket(registerResponse.Token, t)
+	defer disconnectWebSocket(conn, t)
+	writeFrame(conn, "message", "reconnected", signedMessage(message, registerResponse.Salt), t)
+	if ack := readAcknowledgment(conn, t); ack.Type != "ack" || ack.MessageID != original.MessageID {
+		t.Fatalf("expected the original acknowledgment %+v, got %+v", original, ack)
+	}
+
+	resp := authorizedRequest(http.MethodGet, chatURL(original.ChatID, "messages"), registerResponse.Token, nil, t)
+	defer resp.Body.Close()
+	var page struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != original.MessageID {
+		t.Fatalf("expected only message %d in the history, got %+v", original.MessageID, page.Messages)
+	}
+}
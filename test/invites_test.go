@@ -0,0 +1,119 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+)
+
+type Invite struct {
+	ID        int    `json:"id"`
+	Code      string `json:"code"`
+	CreatedBy int    `json:"createdBy"`
+	MaxUses   int    `json:"maxUses"`
+	Uses      int    `json:"uses"`
+	Revoked   bool   `json:"revoked"`
+}
+
+func createInvite(token string, maxUses int, t *testing.T) Invite {
+	reqBody := struct {
+		MaxUses int `json:"maxUses"`
+	}{MaxUses: maxUses}
+	resp := authorizedRequest(http.MethodPost, "http://localhost:8080/admin/invites", token, reqBody, t)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("invite creation failed with status code: %d", resp.StatusCode)
+	}
+
+	var invite Invite
+	if err := json.NewDecoder(resp.Body).Decode(&invite); err != nil {
+		t.Fatalf("failed to decode invite: %v", err)
+	}
+	return invite
+}
+
+func TestAdminInvites(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET10")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET10 must be set")
+	}
+	admin, err := registerClient(secret, adminUsername, t)
+	if err != nil {
+		t.Fatalf("failed to register admin: %v", err)
+	}
+	promoteAdmin(admin.ID, t)
+	// A seeded invite is single-use
+	if _, err := registerClient(secret, "SecondUse", t); err == nil {
+		t.Fatalf("expected a used invite to be rejected")
+	}
+
+	invite := createInvite(admin.Token, 2, t)
+	if invite.CreatedBy != admin.ID || invite.MaxUses != 2 {
+		t.Fatalf("unexpected invite: %+v", invite)
+	}
+	invitee, err := registerClient(invite.Code, "InvitedOne", t)
+	if err != nil {
+		t.Fatalf("failed to register with invite: %v", err)
+	}
+	if _, err := registerClient(invite.Code, "InvitedTwo", t); err != nil {
+		t.Fatalf("failed to register with invite: %v", err)
+	}
+	if _, err := registerClient(invite.Code, "InvitedThree", t); err == nil {
+		t.Fatalf("expected the used up invite to be rejected")
+	}
+
+	// Only admins may manage invites
+	resp := authorizedRequest(http.MethodGet, "http://localhost:8080/admin/invites", invitee.Token, nil, t)
+	expectStatus(resp, http.StatusForbidden, t)
+
+	revoked := createInvite(admin.Token, 1, t)
+	resp = authorizedRequest(http.MethodDelete, fmt.Sprintf("http://localhost:8080/admin/invites/%d", revoked.ID), admin.Token, nil, t)
+	expectStatus(resp, http.StatusNoContent, t)
+	if _, err := registerClient(revoked.Code, "RevokedInvitee", t); err == nil {
+		t.Fatalf("expected a revoked invite to be rejected")
+	}
+
+	resp = authorizedRequest(http.MethodGet, "http://localhost:8080/admin/invites", admin.Token, nil, t)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("listing invites failed with status code: %d", resp.StatusCode)
+	}
+	var invites []Invite
+	if err := json.NewDecoder(resp.Body).Decode(&invites); err != nil {
+		t.Fatalf("failed to decode invites: %v", err)
+	}
+	for _, listed := range invites {
+		if listed.ID == invite.ID && listed.Uses != 2 {
+			t.Fatalf("expected invite to be used twice, got %+v", listed)
+		}
+		if listed.ID == revoked.ID && !listed.Revoked {
+			t.Fatalf("expected invite to be revoked, got %+v", listed)
+		}
+	}
+
+	// Managing invites shows up in the audit log
+	resp = authorizedRequest(http.MethodGet, "http://localhost:8080/admin/audit?limit=10", admin.Token, nil, t)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reading the audit log failed with status code: %d", resp.StatusCode)
+	}
+	var entries []struct {
+		ActorID int    `json:"actorId"`
+		Action  string `json:"action"`
+		Target  string `json:"target"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatalf("failed to decode audit log: %v", err)
+	}
+	revokeTarget := fmt.Sprintf("revoke:%d", revoked.ID)
+	found := false
+	for _, entry := range entries {
+		found = found || (entry.ActorID == admin.ID && entry.Action == "manage_invites" && entry.Target == revokeTarget)
+	}
+	if !found {
+		t.Fatalf("expected the revocation in the audit log, got %+v", entries)
+	}
+	expectStatus(authorizedRequest(http.MethodGet, "http://localhost:8080/admin/audit", invitee.Token, nil, t), http.StatusForbidden, t)
+}
@@ -0,0 +1,47 @@
+package test
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSilentConnectionIsEvicted(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET21")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET21 must be set")
+	}
+	client, err := registerClient(secret, "SilentClient", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+	conn := connectWebSocketWait(client.ID, client.Token, t)
+	defer conn.Close()
+
+	// The client still reads but no longer answers pings, so the server closes the connection after its pong timeout
+	conn.SetPingHandler(func(string) error { return nil })
+	conn.SetReadDeadline(time.Now().Add(3 * keepAliveTimeout))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+			t.Fatalf("server did not close the silent connection")
+		}
+		break
+	}
+
+	// The evicted session no longer counts as present
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		presence, err := checkPresence(client.ID, t)
+		if err == nil && presence.Status == "not_present" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("evicted client is still present: %+v, %v", presence, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func login(username, password string, t *testing.T) (*RegisterResponse, int) {
+	reqBytes, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %v", err)
+	}
+	resp, err := http.Post("http://localhost:8080/login", "application/json", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+
+	var loginResponse RegisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&loginResponse); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return &loginResponse, resp.StatusCode
+}
+
+func TestPasswordLogin(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET11")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET11 must be set")
+	}
+	reqBytes, err := json.Marshal(map[string]string{"secret": secret, "username": "PasswordUser", "password": "first password"})
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %v", err)
+	}
+	resp, err := http.Post("http://localhost:8080/register", "application/json", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+	var client RegisterResponse
+	err = json.NewDecoder(resp.Body).Decode(&client)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if _, status := login("PasswordUser", "wrong password", t); status != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 for a wrong password, got %d", status)
+	}
+	loggedIn, status := login("PasswordUser", "first password", t)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 for the right password, got %d", status)
+	}
+	if loggedIn.ID != client.ID || loggedIn.Salt != client.Salt {
+		t.Fatalf("login returned another client: %+v", loggedIn)
+	}
+	conn := connectWebSocket(loggedIn.Token, t)
+	disconnectWebSocket(conn, t)
+
+	// Changing the password needs the current one and retires the old password
+	changeRequest := map[string]string{"currentPassword": "wrong password", "newPassword": "second password"}
+	expectStatus(authorizedRequest(http.MethodPost, "http://localhost:8080/password", loggedIn.Token, changeRequest, t), http.StatusForbidden, t)
+	changeRequest["currentPassword"] = "first password"
+	expectStatus(authorizedRequest(http.MethodPost, "http://localhost:8080/password", loggedIn.Token, changeRequest, t), http.StatusNoContent, t)
+	if _, status := login("PasswordUser", "first password", t); status != http.StatusUnauthorized {
+		t.Fatalf("expected the old password to be rejected, got %d", status)
+	}
+	if _, status := refreshTokens(loggedIn.RefreshToken, t); status != http.StatusUnauthorized {
+		t.Fatalf("expected refresh tokens to be revoked by the password change, got %d", status)
+	}
+
+	// Repeated failures lock the account, even for the right password
+	for attempt := 0; attempt < 5; attempt++ {
+		if _, status := login("PasswordUser", "wrong password", t); status != http.StatusUnauthorized {
+			t.Fatalf("expected status 401 for a wrong password, got %d", status)
+		}
+	}
+	lockedStatus, lockedBody := rawLogin("PasswordUser", "second password", t)
+	if lockedStatus != http.StatusUnauthorized {
+		t.Fatalf("expected a locked account to reject the right password, got %d", lockedStatus)
+	}
+	// A locked account cannot be told apart from an unknown username
+	if status, body := rawLogin("NoSuchUser", "second password", t); status != lockedStatus || body != lockedBody {
+		t.Fatalf("unknown username got %d %q, locked account %d %q", status, body, lockedStatus, lockedBody)
+	}
+}
+
+func rawLogin(username, password string, t *testing.T) (int, string) {
+	reqBytes, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %v", err)
+	}
+	resp, err := http.Post("http://localhost:8080/login", "application/json", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return resp.StatusCode, string(body)
+}
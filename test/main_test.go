@@ -1,9 +1,16 @@
 package test
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
 	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -14,26 +21,112 @@ import (
 )
 
 var srv *server.Server
+
+// database is the server's store, so tests can inspect it and leave behind what a stopped server would
+var database storage.Store
+var oidcProvider *mockOIDCProvider
 var once sync.Once
 
+// signingKey is the server's configured token signing key, so tests can forge tokens with it
+var signingKey ed25519.PrivateKey
+var configDir string
+
+const signingKeyID = "test-key"
+
+const adminUsername = "InviteAdmin"
+
+// keepAliveTimeout is short so that evicting silent connections can be tested quickly
+const keepAliveTimeout = 2 * time.Second
+
+func testSecrets() []string {
+	var secrets []string
+	for _, name := range []string{"CHAT_SERVER_SECRET", "CHAT_SERVER_SECRET2", "CHAT_SERVER_SECRET3", "CHAT_SERVER_SECRET4",
+		"CHAT_SERVER_SECRET5", "CHAT_SERVER_SECRET6", "CHAT_SERVER_SECRET7", "CHAT_SERVER_SECRET8", "CHAT_SERVER_SECRET9",
+		"CHAT_SERVER_SECRET10", "CHAT_SERVER_SECRET11", "CHAT_SERVER_SECRET12", "CHAT_SERVER_SECRET13",
+		"CHAT_SERVER_SECRET14", "CHAT_SERVER_SECRET15",
+		"CHAT_SERVER_SECRET16", "CHAT_SERVER_SECRET17", "CHAT_SERVER_SECRET18", "CHAT_SERVER_SECRET19", "CHAT_SERVER_SECRET20",
+		"CHAT_SERVER_SECRET21", "CHAT_SERVER_SECRET22",
+		"CHAT_SERVER_SECRET23", "CHAT_SERVER_SECRET24", "CHAT_SERVER_SECRET25",
+		"CHAT_SERVER_SECRET26", "CHAT_SERVER_SECRET27", "CHAT_SERVER_SECRET28", "CHAT_SERVER_SECRET29"} {
+		if secret := os.Getenv(name); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// writeConfigFile writes a configuration file with a freshly generated EdDSA signing key.
+func writeConfigFile() (string, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	configDir, err = os.MkdirTemp("", "chat_server_test")
+	if err != nil {
+		return "", err
+	}
+	keyFile := filepath.Join(configDir, "signing_key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return "", err
+	}
+	configFile := filepath.Join(configDir, "config.yaml")
+	content := fmt.Sprintf("auth:\n  activeKeyId: %s\n  keys:\n    - kid: %s\n      alg: EdDSA\n      privateKeyFile: %s\n",
+		signingKeyID, signingKeyID, keyFile)
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		return "", err
+	}
+	signingKey = privateKey
+	return configFile, nil
+}
+
 func setup() {
 	once.Do(func() {
 		// Load server configuration
+		configFile, err := writeConfigFile()
+		if err != nil {
+			log.Fatalf("Configuration file could not be written: %v", err)
+		}
+		os.Setenv("CHAT_CONFIG_FILE", configFile)
 		os.Setenv("APP_ENV", "test")
-		authentication.LoadSecrets()
-		serverConfig := config.LoadServerConfig()
-		databaseConfig, err := config.LoadDataBaseConfig()
+		os.Setenv("PONG_TIMEOUT", keepAliveTimeout.String())
+		// The tests need no database server unless DB_DRIVER asks for one
+		if os.Getenv("DB_DRIVER") == "" {
+			os.Setenv("DB_DRIVER", config.DriverMemory)
+		}
+		oidcProvider = newMockOIDCProvider()
+		os.Setenv("OIDC_ISSUER", oidcProvider.issuer())
+		os.Setenv("OIDC_CLIENT_ID", oidcClientID)
+		os.Setenv("OIDC_CLIENT_SECRET", oidcClientSecret)
+		os.Setenv("OIDC_REDIRECT_URL", "http://localhost:8080/oidc/callback")
+		serverConfig, err := config.Load(nil)
 		if err != nil {
-			log.Fatalf("Database config could not be loaded: %v", err)
+			log.Fatalf("Configuration could not be loaded: %v", err)
+		}
+		if err := authentication.LoadSigningKeys(&serverConfig.Auth); err != nil {
+			log.Fatalf("Signing keys could not be loaded: %v", err)
 		}
+		authentication.ConfigureOIDC(serverConfig.Auth.OIDC)
 
 		// Initialize the database
-		db, err := storage.ConnectToDatabase(databaseConfig)
+		db, err := storage.ConnectToDatabase(&serverConfig.Database)
 		if err != nil {
 			log.Fatalf("Database connection failed: %v", err)
 		}
+		if _, err := db.MigrateUp(); err != nil {
+			log.Fatalf("Database could not be migrated: %v", err)
+		}
+
+		// The secrets the tests register with become single-use invites
+		if err := db.SeedInvites(testSecrets()); err != nil {
+			log.Fatalf("Invites could not be seeded: %v", err)
+		}
 
 		// Create and start the server
+		database = db
 		srv = server.NewServer(serverConfig, db)
 		go func() {
 			if err := srv.Start(); err != nil {
@@ -46,12 +139,25 @@ func setup() {
 	})
 }
 
+// promoteAdmin makes a registered client an admin like the promote-admin command does.
+func promoteAdmin(clientID int, t *testing.T) {
+	if err := database.SetServerRole(clientID, models.RoleAdmin); err != nil {
+		t.Fatalf("failed to promote client %d: %v", clientID, err)
+	}
+}
+
 func teardown() {
 	if srv != nil {
 		if err := srv.Stop(); err != nil {
 			log.Printf("Error stopping server: %v", err)
 		}
 	}
+	if oidcProvider != nil {
+		oidcProvider.server.Close()
+	}
+	if configDir != "" {
+		os.RemoveAll(configDir)
+	}
 }
 
 func TestMain(m *testing.M) {
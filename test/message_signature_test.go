@@ -0,0 +1,56 @@
+package test
+
+import (
+	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"os"
+	"testing"
+	"time"
+)
+
+func expectError(ack Acknowledgment, code string, t *testing.T) {
+	if ack.Type != "error" || ack.Code != code {
+		t.Fatalf("expected %s error, got %+v", code, ack)
+	}
+}
+
+func TestMessageReplayIsRejected(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET9")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET9 must be set")
+	}
+	registerResponse, err := registerClient(secret, "ReplaySender", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+	conn := connectWebSocket(registerResponse.Token, t)
+	defer disconnectWebSocket(conn, t)
+
+	msg := signedMessage(models.Message{ClientID: registerResponse.ID, Text: "only once"}, registerResponse.Salt)
+	writeFrame(conn, "message", "original", msg, t)
+	if ack := readAcknowledgment(conn, t); ack.Type != "ack" {
+		t.Fatalf("expected the original message to be accepted, got %+v", ack)
+	}
+
+	// The identical frame is a replay
+	writeFrame(conn, "message", "replay", msg, t)
+	expectError(readAcknowledgment(conn, t), "replayed_message", t)
+
+	// Moving a signed message into another chat breaks its signature
+	moved := signedMessage(models.Message{ClientID: registerResponse.ID, Text: "moved"}, registerResponse.Salt)
+	moved.ChatID = "some-other-chat"
+	writeFrame(conn, "message", "moved", moved, t)
+	expectError(readAcknowledgment(conn, t), "invalid_hash", t)
+
+	// A correctly signed but old message is outside the clock skew
+	stale := models.Message{ClientID: registerResponse.ID, Text: "stale", Nonce: "stale-nonce"}
+	stale.Timestamp_ms = time.Now().Add(-time.Hour).UnixMilli()
+	stale.Hash = authentication.SignMessage(stale, registerResponse.Salt)
+	writeFrame(conn, "message", "stale", stale, t)
+	expectError(readAcknowledgment(conn, t), "stale_timestamp", t)
+
+	// A message claiming another sender is rejected even when it is signed correctly
+	impersonated := signedMessage(models.Message{ClientID: registerResponse.ID + 1, Text: "not me"}, registerResponse.Salt)
+	writeFrame(conn, "message", "impersonated", impersonated, t)
+	expectError(readAcknowledgment(conn, t), "sender_mismatch", t)
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+)
+
+// startOIDCLogin runs the redirect chain up to the callback and returns the browser, which holds
+// the state cookie, together with the callback URL the identity provider sent it to.
+func startOIDCLogin(t *testing.T) (*http.Client, string) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %v", err)
+	}
+	browser := &http.Client{Jar: jar, CheckRedirect: func(request *http.Request, via []*http.Request) error {
+		if request.URL.Path == "/oidc/callback" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}}
+	resp, err := browser.Get("http://localhost:8080/oidc/login")
+	if err != nil {
+		t.Fatalf("failed to start OIDC login: %v", err)
+	}
+	defer resp.Body.Close()
+	callbackURL, err := resp.Location()
+	if resp.StatusCode != http.StatusFound || err != nil {
+		t.Fatalf("expected a redirect to the callback, got status code %d", resp.StatusCode)
+	}
+	return browser, callbackURL.String()
+}
+
+// oidcLogin runs the whole redirect chain and returns the client together with the callback URL it ended on.
+func oidcLogin(t *testing.T) (*RegisterResponse, string) {
+	browser, callbackURL := startOIDCLogin(t)
+	resp, err := browser.Get(callbackURL)
+	if err != nil {
+		t.Fatalf("failed to log in through OIDC: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("OIDC login failed with status code: %d", resp.StatusCode)
+	}
+
+	var client RegisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&client); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return &client, callbackURL
+}
+
+// callbackWithState requests the callback URL with the given value in the state cookie.
+func callbackWithState(callbackURL, state string, t *testing.T) *http.Response {
+	request, err := http.NewRequest(http.MethodGet, callbackURL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	request.AddCookie(&http.Cookie{Name: "oidc_state", Value: state})
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("failed to request callback: %v", err)
+	}
+	return resp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	oidcProvider.logInAs("subject-1", "alice.oidc")
+	first, callbackURL := oidcLogin(t)
+	if first.Username != "aliceoidc" || first.Token == "" || first.RefreshToken == "" {
+		t.Fatalf("unexpected client after first login: %+v", first)
+	}
+	conn := connectWebSocket(first.Token, t)
+	disconnectWebSocket(conn, t)
+
+	// The same subject is mapped to the same client again
+	again, _ := oidcLogin(t)
+	if again.ID != first.ID || again.Salt != first.Salt {
+		t.Fatalf("expected the second login to reach client %d, got %+v", first.ID, again)
+	}
+
+	// Another subject with the same username gets a client of its own
+	oidcProvider.logInAs("subject-2", "alice.oidc")
+	other, _ := oidcLogin(t)
+	if other.ID == first.ID || other.Username == first.Username {
+		t.Fatalf("expected a new client for another subject, got %+v", other)
+	}
+
+	// A callback cannot be replayed, its state is used up
+	replayed, err := url.Parse(callbackURL)
+	if err != nil {
+		t.Fatalf("failed to parse callback URL: %v", err)
+	}
+	expectStatus(callbackWithState(callbackURL, replayed.Query().Get("state"), t), http.StatusUnauthorized, t)
+}
+
+func TestOIDCCallbackNeedsStateCookie(t *testing.T) {
+	oidcProvider.logInAs("subject-3", "mallory.oidc")
+	_, attackerCallback := startOIDCLogin(t)
+	victim, _ := startOIDCLogin(t)
+
+	// A callback from a login started elsewhere is refused, with no cookie or with another login's cookie
+	resp, err := http.Get(attackerCallback)
+	if err != nil {
+		t.Fatalf("failed to request callback: %v", err)
+	}
+	expectStatus(resp, http.StatusUnauthorized, t)
+	resp, err = victim.Get(attackerCallback)
+	if err != nil {
+		t.Fatalf("failed to request callback: %v", err)
+	}
+	expectStatus(resp, http.StatusUnauthorized, t)
+	expectStatus(callbackWithState(attackerCallback, "forged", t), http.StatusUnauthorized, t)
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcClientID     = "chat-server"
+	oidcClientSecret = "mock-client-secret"
+)
+
+type mockAuthorization struct {
+	nonce         string
+	codeChallenge string
+	subject       string
+	username      string
+}
+
+// mockOIDCProvider is a minimal identity provider that logs in whichever user was set last
+// without asking, so the whole authorization code flow can run inside the test suite.
+type mockOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	mutex    sync.Mutex
+	subject  string
+	username string
+	codes    map[string]mockAuthorization
+}
+
+func newMockOIDCProvider() *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	provider := &mockOIDCProvider{key: key, codes: make(map[string]mockAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("GET /authorize", provider.authorize)
+	mux.HandleFunc("POST /token", provider.token)
+	mux.HandleFunc("GET /jwks", provider.jwks)
+	provider.server = httptest.NewServer(mux)
+	return provider
+}
+
+func (provider *mockOIDCProvider) issuer() string {
+	return provider.server.URL
+}
+
+// logInAs sets the user the provider authenticates on the next authorization request.
+func (provider *mockOIDCProvider) logInAs(subject, username string) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.subject = subject
+	provider.username = username
+}
+
+func (provider *mockOIDCProvider) discovery(writer http.ResponseWriter, request *http.Request) {
+	json.NewEncoder(writer).Encode(map[string]string{
+		"issuer":                 provider.issuer(),
+		"authorization_endpoint": provider.issuer() + "/authorize",
+		"token_endpoint":         provider.issuer() + "/token",
+		"jwks_uri":               provider.issuer() + "/jwks",
+	})
+}
+
+func (provider *mockOIDCProvider) authorize(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	if query.Get("client_id") != oidcClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(writer, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(big.NewInt(time.Now().UnixNano()).Bytes())
+	provider.mutex.Lock()
+	provider.codes[code] = mockAuthorization{
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		subject:       provider.subject,
+		username:      provider.username,
+	}
+	provider.mutex.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(writer, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	redirectQuery := redirect.Query()
+	redirectQuery.Set("code", code)
+	redirectQuery.Set("state", query.Get("state"))
+	redirect.RawQuery = redirectQuery.Encode()
+	http.Redirect(writer, request, redirect.String(), http.StatusFound)
+}
+
+func (provider *mockOIDCProvider) token(writer http.ResponseWriter, request *http.Request) {
+	clientID, clientSecret, ok := request.BasicAuth()
+	if !ok || clientID != oidcClientID || clientSecret != oidcClientSecret {
+		http.Error(writer, "invalid client", http.StatusUnauthorized)
+		return
+	}
+	provider.mutex.Lock()
+	authorization, ok := provider.codes[request.FormValue("code")]
+	delete(provider.codes, request.FormValue("code"))
+	provider.mutex.Unlock()
+	challenge := sha256.Sum256([]byte(request.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+		http.Error(writer, "invalid grant", http.StatusBadRequest)
+		return
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                provider.issuer(),
+		"sub":                authorization.subject,
+		"aud":                oidcClientID,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              authorization.nonce,
+		"preferred_username": authorization.username,
+	})
+	idToken.Header["kid"] = "mock"
+	signed, err := idToken.SignedString(provider.key)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(writer).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+func (provider *mockOIDCProvider) jwks(writer http.ResponseWriter, request *http.Request) {
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(provider.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(provider.key.E)).Bytes()),
+		}},
+	})
+}
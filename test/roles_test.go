@@ -0,0 +1,102 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// readReply skips message frames until the ack or error answering the frame with the given ID arrives.
+func readReply(conn *websocket.Conn, id string, t *testing.T) Acknowledgment {
+	for {
+		ack := readAcknowledgment(conn, t)
+		if (ack.Type == "ack" || ack.Type == "error") && ack.ID == id {
+			return ack
+		}
+	}
+}
+
+func sendAndConfirm(client *RegisterResponse, chatID, text string, t *testing.T) int {
+	conn := connectWebSocket(client.Token, t)
+	defer disconnectWebSocket(conn, t)
+	sendMessage(client.ID, conn, chatID, text, client.Salt, t)
+	ack := readReply(conn, text, t)
+	if ack.Type != "ack" {
+		t.Fatalf("message %q was not accepted: %+v", text, ack)
+	}
+	return ack.MessageID
+}
+
+func TestChatRoles(t *testing.T) {
+	var secrets [3]string
+	for i, name := range []string{"CHAT_SERVER_SECRET12", "CHAT_SERVER_SECRET13", "CHAT_SERVER_SECRET14"} {
+		if secrets[i] = os.Getenv(name); secrets[i] == "" {
+			t.Fatalf("environment variable %s must be set", name)
+		}
+	}
+	owner, err := registerClient(secrets[0], "RoleOwner", t)
+	if err != nil {
+		t.Fatalf("failed to register owner: %v", err)
+	}
+	moderator, err := registerClient(secrets[1], "RoleModerator", t)
+	if err != nil {
+		t.Fatalf("failed to register moderator: %v", err)
+	}
+	member, err := registerClient(secrets[2], "RoleMember", t)
+	if err != nil {
+		t.Fatalf("failed to register member: %v", err)
+	}
+	chatID := "roles-room"
+	createChat(owner.Token, chatID, []*RegisterResponse{moderator, member}, t)
+
+	// Only the owner hands out roles
+	roleURL := func(clientID int) string { return chatURL(chatID, fmt.Sprintf("members/%d/role", clientID)) }
+	promotion := map[string]string{"role": "moderator"}
+	expectStatus(authorizedRequest(http.MethodPut, roleURL(member.ID), member.Token, promotion, t), http.StatusForbidden, t)
+	expectStatus(authorizedRequest(http.MethodPut, roleURL(moderator.ID), owner.Token, promotion, t), http.StatusNoContent, t)
+
+	resp := authorizedRequest(http.MethodGet, chatURL(chatID, "members"), member.Token, nil, t)
+	var membersResponse ChatMembersResponse
+	err = json.NewDecoder(resp.Body).Decode(&membersResponse)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode members: %v", err)
+	}
+	roles := map[int]string{}
+	for _, listed := range membersResponse.Members {
+		roles[listed.ID] = listed.Role
+	}
+	if roles[owner.ID] != "owner" || roles[moderator.ID] != "moderator" || roles[member.ID] != "member" {
+		t.Fatalf("unexpected roles: %+v", membersResponse.Members)
+	}
+
+	// Members may only delete their own messages, moderators anyone's
+	ownerMessage := sendAndConfirm(owner, chatID, "from the owner", t)
+	memberMessage := sendAndConfirm(member, chatID, "from the member", t)
+	messageURL := func(messageID int) string { return chatURL(chatID, fmt.Sprintf("messages/%d", messageID)) }
+	expectStatus(authorizedRequest(http.MethodDelete, messageURL(ownerMessage), member.Token, nil, t), http.StatusForbidden, t)
+	expectStatus(authorizedRequest(http.MethodDelete, messageURL(memberMessage), moderator.Token, nil, t), http.StatusNoContent, t)
+
+	// The WebSocket dispatcher applies the same rules
+	ownMessage := sendAndConfirm(member, chatID, "deleted by myself", t)
+	conn := connectWebSocket(member.Token, t)
+	writeFrame(conn, "delete", "delete-owner", map[string]int{"messageId": ownerMessage}, t)
+	if reply := readReply(conn, "delete-owner", t); reply.Type != "error" || reply.Code != "forbidden" {
+		t.Fatalf("expected deleting the owner's message to be forbidden, got %+v", reply)
+	}
+	writeFrame(conn, "delete", "delete-own", map[string]int{"messageId": ownMessage}, t)
+	if reply := readReply(conn, "delete-own", t); reply.Type != "ack" || reply.MessageID != ownMessage {
+		t.Fatalf("expected deleting the own message to succeed, got %+v", reply)
+	}
+	disconnectWebSocket(conn, t)
+
+	// Kicking needs the permission and a higher rank than the kicked member
+	kickURL := chatURL(chatID, "kick")
+	expectStatus(authorizedRequest(http.MethodPost, kickURL, member.Token, map[string]int{"clientId": moderator.ID}, t), http.StatusForbidden, t)
+	expectStatus(authorizedRequest(http.MethodPost, kickURL, moderator.Token, map[string]int{"clientId": owner.ID}, t), http.StatusForbidden, t)
+	expectStatus(authorizedRequest(http.MethodPost, kickURL, moderator.Token, map[string]int{"clientId": member.ID}, t), http.StatusNoContent, t)
+	expectStatus(authorizedRequest(http.MethodGet, chatURL(chatID, "members"), member.Token, nil, t), http.StatusForbidden, t)
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// SyncPage holds the payload of a sync frame.
+type SyncPage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"hasMore"`
+	LastSeq  int       `json:"lastSeq"`
+}
+
+func TestSequenceNumbersAndSync(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET16")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET16 must be set")
+	}
+	client, err := registerClient(secret, "SequencedSender", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+	chatID := "sequenced-room"
+	createChat(client.Token, chatID, nil, t)
+
+	// A second session of the sender receives the broadcasts with their sequence numbers
+	listener, err := dialWebSocket(client.Token, "listener")
+	if err != nil {
+		t.Fatalf("failed to connect listener: %v", err)
+	}
+	defer disconnectWebSocket(listener, t)
+
+	for seq, text := range []string{"first", "second", "third"} {
+		if ack := sendAndConfirmSeq(client, chatID, text, t); ack != seq+1 {
+			t.Fatalf("expected %q to get sequence number %d, got %d", text, seq+1, ack)
+		}
+		if msg := readMessage(listener, t); msg.Text != text || msg.Seq != seq+1 {
+			t.Fatalf("expected broadcast of %q with sequence number %d, got %+v", text, seq+1, msg)
+		}
+	}
+
+	// A client that saw the first message and then the third asks for exactly the gap
+	conn := connectWebSocket(client.Token, t)
+	defer disconnectWebSocket(conn, t)
+	writeFrame(conn, "sync", "gap", map[string]interface{}{"chatId": chatID, "afterSeq": 1, "beforeSeq": 3}, t)
+	envelope := readFrame(conn, t)
+	var page SyncPage
+	if err := json.Unmarshal(envelope.Payload, &page); err != nil || envelope.Type != "sync" {
+		t.Fatalf("expected a sync frame, got %s: %s", envelope.Type, envelope.Payload)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].Seq != 2 || page.Messages[0].Text != "second" || page.LastSeq != 3 {
+		t.Fatalf("unexpected sync page: %+v", page)
+	}
+}
+
+func sendAndConfirmSeq(client *RegisterResponse, chatID, text string, t *testing.T) int {
+	conn := connectWebSocket(client.Token, t)
+	defer disconnectWebSocket(conn, t)
+	sendMessage(client.ID, conn, chatID, text, client.Salt, t)
+	ack := readReply(conn, text, t)
+	if ack.Type != "ack" {
+		t.Fatalf("message %q was not accepted: %+v", text, ack)
+	}
+	return ack.Seq
+}
@@ -0,0 +1,165 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+type SessionResponse struct {
+	SessionID string `json:"sessionId"`
+	DeviceID  string `json:"deviceId"`
+}
+
+func listSessions(token string, t *testing.T) []SessionResponse {
+	resp := authorizedRequest(http.MethodGet, "http://localhost:8080/sessions", token, nil, t)
+	var sessions []SessionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		t.Fatalf("failed to decode sessions: %v", err)
+	}
+	expectStatus(resp, http.StatusOK, t)
+	return sessions
+}
+
+func TestMultipleDevices(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET7")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET7 must be set")
+	}
+	client, err := registerClient(secret, "MultiDevice", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+
+	phone, err := dialWebSocket(client.Token, "phone")
+	if err != nil {
+		t.Fatalf("failed to connect phone: %v", err)
+	}
+	defer disconnectWebSocket(phone, t)
+	laptop, err := dialWebSocket(client.Token, "laptop")
+	if err != nil {
+		t.Fatalf("failed to connect laptop: %v", err)
+	}
+
+	sessions := listSessions(client.Token, t)
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+
+	// A note written on the phone shows up on the laptop
+	sendMessage(client.ID, phone, "", "Note to self", client.Salt, t)
+	if ack := readAcknowledgment(phone, t); ack.Type != "ack" {
+		t.Fatalf("phone received unexpected acknowledgment: %+v", ack)
+	}
+	if msg := readMessage(laptop, t); msg.Text != "Note to self" {
+		t.Fatalf("laptop received incorrect message: %s", msg.Text)
+	}
+
+	// Terminating the laptop session closes its connection
+	var laptopSession string
+	for _, session := range sessions {
+		if session.DeviceID == "laptop" {
+			laptopSession = session.SessionID
+		}
+	}
+	expectStatus(authorizedRequest(http.MethodDelete, "http://localhost:8080/sessions/"+laptopSession, client.Token, nil, t), http.StatusNoContent, t)
+	laptop.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := laptop.ReadMessage(); err == nil {
+		t.Fatalf("laptop session is still open")
+	}
+	laptop.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if sessions := listSessions(client.Token, t); len(sessions) != 1 || sessions[0].DeviceID != "phone" {
+		t.Fatalf("expected only the phone session, got %+v", sessions)
+	}
+}
+
+// readUntilSynced collects the message frames that arrive before the answer to a sync request.
+// Frames are handled in order, so the answer also shows that the frames sent before were handled.
+// The answer is an error while the client has no self chat yet.
+func readUntilSynced(client *RegisterResponse, conn *websocket.Conn, t *testing.T) []Message {
+	writeFrame(conn, "sync", "synced", map[string]interface{}{"chatId": fmt.Sprintf("self-%d", client.ID)}, t)
+	var received []Message
+	for {
+		envelope := readFrame(conn, t)
+		if envelope.ID == "synced" {
+			return received
+		}
+		var msg Message
+		if err := json.Unmarshal(envelope.Payload, &msg); err != nil || envelope.Type != "message" {
+			t.Fatalf("expected a message frame, got %s: %s", envelope.Type, envelope.Payload)
+		}
+		received = append(received, msg)
+	}
+}
+
+// connectDevice connects a session of the device and returns the messages replayed to it.
+func connectDevice(client *RegisterResponse, device string, t *testing.T) (*websocket.Conn, []Message) {
+	conn, err := dialWebSocket(client.Token, device)
+	if err != nil {
+		t.Fatalf("failed to connect %s: %v", device, err)
+	}
+	return conn, readUntilSynced(client, conn, t)
+}
+
+func TestDeviceCursorAcrossReconnects(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET22")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET22 must be set")
+	}
+	client, err := registerClient(secret, "CursorClient", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+
+	// The tablet is known before the phone writes while the tablet is offline
+	tablet, _ := connectDevice(client, "tablet", t)
+	disconnectWebSocket(tablet, t)
+	phone, err := dialWebSocket(client.Token, "phone")
+	if err != nil {
+		t.Fatalf("failed to connect phone: %v", err)
+	}
+	var sent []int
+	for _, text := range []string{"one", "two", "three"} {
+		sendMessage(client.ID, phone, "", text, client.Salt, t)
+		sent = append(sent, readReply(phone, text, t).MessageID)
+	}
+	disconnectWebSocket(phone, t)
+
+	// The tablet receives what its client wrote on the phone and acknowledges out of order
+	tablet, replayed := connectDevice(client, "tablet", t)
+	if len(replayed) != 3 || replayed[0].ID != sent[0] || replayed[2].ID != sent[2] {
+		t.Fatalf("expected messages %v on the tablet, got %+v", sent, replayed)
+	}
+	sendDeliveryAck(tablet, sent[2], t)
+	sendDeliveryAck(tablet, sent[0], t)
+	readUntilSynced(client, tablet, t)
+	disconnectWebSocket(tablet, t)
+
+	// Only the message in the gap comes again
+	tablet, replayed = connectDevice(client, "tablet", t)
+	if len(replayed) != 1 || replayed[0].ID != sent[1] {
+		t.Fatalf("expected only message %d on the tablet, got %+v", sent[1], replayed)
+	}
+	sendDeliveryAck(tablet, sent[1], t)
+	readUntilSynced(client, tablet, t)
+	disconnectWebSocket(tablet, t)
+
+	tablet, replayed = connectDevice(client, "tablet", t)
+	defer disconnectWebSocket(tablet, t)
+	if len(replayed) != 0 {
+		t.Fatalf("expected nothing on the tablet, got %+v", replayed)
+	}
+
+	// The phone wrote the messages, so they are never replayed to it
+	phone, replayed = connectDevice(client, "phone", t)
+	defer disconnectWebSocket(phone, t)
+	if len(replayed) != 0 {
+		t.Fatalf("expected nothing on the phone, got %+v", replayed)
+	}
+}
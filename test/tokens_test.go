@@ -0,0 +1,200 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type TokensResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+func refreshTokens(refreshToken string, t *testing.T) (*TokensResponse, int) {
+	reqBytes, err := json.Marshal(map[string]string{"refreshToken": refreshToken})
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %v", err)
+	}
+	resp, err := http.Post("http://localhost:8080/token/refresh", "application/json", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		t.Fatalf("failed to refresh token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	var tokens TokensResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatalf("failed to decode tokens: %v", err)
+	}
+	return &tokens, resp.StatusCode
+}
+
+func TestRefreshAndRevokeTokens(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET8")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET8 must be set")
+	}
+	client, err := registerClient(secret, "TokenRotator", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+
+	// Refreshing rotates the refresh token
+	tokens, status := refreshTokens(client.RefreshToken, t)
+	if status != http.StatusOK {
+		t.Fatalf("refresh failed with status code %d", status)
+	}
+	if tokens.RefreshToken == client.RefreshToken || tokens.ExpiresIn <= 0 {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+
+	// Reusing the old refresh token fails and kills the whole token family
+	if _, status := refreshTokens(client.RefreshToken, t); status != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token returned status code %d", status)
+	}
+	if _, status := refreshTokens(tokens.RefreshToken, t); status != http.StatusUnauthorized {
+		t.Fatalf("refresh token of a compromised family returned status code %d", status)
+	}
+
+	// Revoking the access token closes the session that uses it and rejects further requests
+	conn := connectWebSocket(tokens.Token, t)
+	defer conn.Close()
+	expectStatus(authorizedRequest(http.MethodPost, "http://localhost:8080/token/revoke", tokens.Token, nil, t), http.StatusNoContent, t)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("session with revoked token is still open")
+	}
+	expectStatus(authorizedRequest(http.MethodGet, "http://localhost:8080/sessions", tokens.Token, nil, t), http.StatusUnauthorized, t)
+}
+
+// forgeToken signs an access token for the subject that expires at expiresAt.
+func forgeToken(method jwt.SigningMethod, key interface{}, subject string, expiresAt time.Time, t *testing.T) string {
+	token := jwt.NewWithClaims(method, jwt.RegisteredClaims{
+		ID:        "forged-" + subject,
+		Subject:   subject,
+		IssuedAt:  jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	})
+	token.Header["kid"] = signingKeyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// handshakeStatus returns the status code the WebSocket endpoint answers the handshake with.
+func handshakeStatus(token string, t *testing.T) int {
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://localhost:8080/ws", http.Header{
+		"Authorization":          {"Bearer " + token},
+		"Sec-WebSocket-Protocol": {protocolVersion},
+	})
+	if err == nil {
+		conn.Close()
+		return http.StatusSwitchingProtocols
+	}
+	if resp == nil {
+		t.Fatalf("handshake failed without a response: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestForgedTokensAreRejected(t *testing.T) {
+	secret := os.Getenv("CHAT_SERVER_SECRET23")
+	if secret == "" {
+		t.Fatalf("environment variable CHAT_SERVER_SECRET23 must be set")
+	}
+	client, err := registerClient(secret, "ForgedTokenVictim", t)
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+	subject := strconv.Itoa(client.ID)
+
+	// A token signed with the configured key is accepted, so the rejections below are down to the forgery
+	valid := forgeToken(jwt.SigningMethodEdDSA, signingKey, subject, time.Now().Add(time.Minute), t)
+	expectStatus(authorizedRequest(http.MethodGet, "http://localhost:8080/sessions", valid, nil, t), http.StatusOK, t)
+	if status := handshakeStatus(valid, t); status != http.StatusSwitchingProtocols {
+		t.Fatalf("valid token was refused with status code %d", status)
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	forged := map[string]string{
+		"expired":         forgeToken(jwt.SigningMethodEdDSA, signingKey, subject, time.Now().Add(-time.Minute), t),
+		"wrong signature": forgeToken(jwt.SigningMethodEdDSA, otherKey, subject, time.Now().Add(time.Minute), t),
+		"alg none":        forgeToken(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, subject, time.Now().Add(time.Minute), t),
+	}
+	for name, token := range forged {
+		resp := authorizedRequest(http.MethodGet, "http://localhost:8080/sessions", token, nil, t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s token returned status code %d on /sessions", name, resp.StatusCode)
+		}
+		if status := handshakeStatus(token, t); status != http.StatusUnauthorized {
+			t.Fatalf("%s token returned status code %d on /ws", name, status)
+		}
+	}
+}
+
+func TestJSONWebKeySet(t *testing.T) {
+	resp, err := http.Get("http://localhost:8080/.well-known/jwks.json")
+	if err != nil {
+		t.Fatalf("failed to fetch key set: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	var keySet struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		t.Fatalf("failed to decode key set: %v", err)
+	}
+	// Symmetric keys must never be published
+	var published map[string]string
+	for _, key := range keySet.Keys {
+		if key["kty"] == "oct" || key["k"] != "" {
+			t.Fatalf("key set contains a symmetric key: %v", key)
+		}
+		if key["kid"] == signingKeyID {
+			published = key
+		}
+	}
+	if published == nil || published["kty"] != "OKP" || published["crv"] != "Ed25519" || published["alg"] != "EdDSA" || published["use"] != "sig" {
+		t.Fatalf("expected the configured key %s in the key set, got %v", signingKeyID, keySet.Keys)
+	}
+	publicKey, err := base64.RawURLEncoding.DecodeString(published["x"])
+	if err != nil || !bytes.Equal(publicKey, signingKey.Public().(ed25519.PublicKey)) {
+		t.Fatalf("published key does not match the configured key: %v", published)
+	}
+
+	// A token the server issued verifies against the published key alone
+	oidcProvider.logInAs("subject-jwks", "jwks.reader")
+	client, _ := oidcLogin(t)
+	token, err := jwt.Parse(client.Token, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != published["kid"] {
+			return nil, fmt.Errorf("token names key %v", token.Header["kid"])
+		}
+		return ed25519.PublicKey(publicKey), nil
+	}, jwt.WithValidMethods([]string{published["alg"]}))
+	if err != nil || !token.Valid {
+		t.Fatalf("issued token does not verify against the published key: %v", err)
+	}
+}
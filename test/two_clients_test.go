@@ -1,44 +1,119 @@
 package test
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/Schwarf/prototype_chat_server/internal/authentication"
+	"github.com/Schwarf/prototype_chat_server/internal/models"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
-func sendMessage(clientID int, conn *websocket.Conn, text, salt string, t *testing.T) {
-	hash := authentication.GenerateHash(text, salt)
-	msg := Message{
-		ClientID:    clientID,
-		Text:        text,
-		TimestampMs: 0, // Use actual timestamp if needed
-		Hash:        hash,
+func authorizedRequest(method, url, token string, body interface{}, t *testing.T) *http.Response {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
 	}
-	msgBytes, err := json.Marshal(msg)
+	request, err := http.NewRequest(method, url, &reqBody)
 	if err != nil {
-		t.Fatalf("failed to marshal message: %v", err)
+		t.Fatalf("failed to create request: %v", err)
 	}
-	err = conn.WriteMessage(websocket.TextMessage, msgBytes)
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
-		t.Fatalf("failed to send message: %v", err)
+		t.Fatalf("request %s %s failed: %v", method, url, err)
 	}
+	return resp
+}
+
+// createChat creates the chat, invites the members and has each of them join.
+func createChat(token, chatID string, members []*RegisterResponse, t *testing.T) {
+	reqBody := struct {
+		ChatID  string `json:"chatId"`
+		Members []int  `json:"members"`
+	}{ChatID: chatID}
+	for _, member := range members {
+		reqBody.Members = append(reqBody.Members, member.ID)
+	}
+	resp := authorizedRequest(http.MethodPost, "http://localhost:8080/chats", token, reqBody, t)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat creation failed with status code: %d", resp.StatusCode)
+	}
+	for _, member := range members {
+		joined := authorizedRequest(http.MethodPost, chatURL(chatID, "join"), member.Token, nil, t)
+		joined.Body.Close()
+		if joined.StatusCode != http.StatusNoContent {
+			t.Fatalf("client %d failed to join chat %s with status code: %d", member.ID, chatID, joined.StatusCode)
+		}
+	}
+	t.Logf("Created chat %s", chatID)
+}
+
+// signedMessage stamps the message with the current time and a fresh nonce and signs it.
+func signedMessage(message models.Message, salt string) models.Message {
+	message.Timestamp_ms = time.Now().UnixMilli()
+	message.Nonce = uuid.NewString()
+	message.Hash = authentication.SignMessage(message, salt)
+	return message
+}
+
+func sendMessage(clientID int, conn *websocket.Conn, chatID, text, salt string, t *testing.T) {
+	msg := signedMessage(models.Message{ClientID: clientID, ChatID: chatID, Text: text}, salt)
+	writeFrame(conn, "message", text, msg, t)
 }
 
 func readMessage(conn *websocket.Conn, t *testing.T) Message {
-	_, message, err := conn.ReadMessage()
-	if err != nil {
-		t.Fatalf("failed to read message: %v", err)
+	envelope := readFrame(conn, t)
+	if envelope.Type != "message" {
+		t.Fatalf("expected a message frame, got %s: %s", envelope.Type, envelope.Payload)
 	}
 
 	var msg Message
-	if err := json.Unmarshal(message, &msg); err != nil {
+	if err := json.Unmarshal(envelope.Payload, &msg); err != nil {
 		t.Fatalf("failed to unmarshal message: %v", err)
 	}
 	return msg
 }
 
+// Acknowledgment holds the payload of the ack or error frame answering a sent frame.
+type Acknowledgment struct {
+	Type        string `json:"-"`
+	ID          string `json:"-"`
+	MessageID   int    `json:"messageId"`
+	ChatID      string `json:"chatId"`
+	TimestampMs int64  `json:"timestamp_ms"`
+	Seq         int    `json:"seq"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+}
+
+func readAcknowledgment(conn *websocket.Conn, t *testing.T) Acknowledgment {
+	envelope := readFrame(conn, t)
+	var ack Acknowledgment
+	if err := json.Unmarshal(envelope.Payload, &ack); err != nil {
+		t.Fatalf("failed to unmarshal acknowledgment: %v", err)
+	}
+	ack.Type = envelope.Type
+	ack.ID = envelope.ID
+	return ack
+}
+
+func sendDeliveryAck(conn *websocket.Conn, messageID int, t *testing.T) {
+	ack := struct {
+		MessageID int `json:"messageId"`
+	}{MessageID: messageID}
+	writeFrame(conn, "delivered", "", ack, t)
+}
+
 func TestTwoClientsMessageExchange(t *testing.T) {
 	// Set up environment
 	secret := os.Getenv("CHAT_SERVER_SECRET")
@@ -70,9 +145,16 @@ func TestTwoClientsMessageExchange(t *testing.T) {
 	defer disconnectWebSocket(connB, t)
 	t.Log("Client B connected to WebSocket")
 
-	// Client A sends a message
-	sendMessage(registerResponseA.ID, connA, "Hello from Client A", registerResponseA.Salt, t)
+	// Client A opens a chat with Client B
+	chatID := fmt.Sprintf("chat-%d-%d", registerResponseA.ID, registerResponseB.ID)
+	createChat(registerResponseA.Token, chatID, []*RegisterResponse{registerResponseB}, t)
+
+	// Client A sends a message, the acknowledgment carries the frame's ID back
+	sendMessage(registerResponseA.ID, connA, chatID, "Hello from Client A", registerResponseA.Salt, t)
 	t.Log("Client A sent a message")
+	if ack := readAcknowledgment(connA, t); ack.Type != "ack" || ack.MessageID == 0 || ack.ID != "Hello from Client A" {
+		t.Fatalf("Client A received unexpected acknowledgment: %+v", ack)
+	}
 
 	// Client B reads the message
 	msg := readMessage(connB, t)
@@ -84,8 +166,11 @@ func TestTwoClientsMessageExchange(t *testing.T) {
 	}
 
 	// Client B sends a message
-	sendMessage(registerResponseB.ID, connB, "Hello from Client B", registerResponseB.Salt, t)
+	sendMessage(registerResponseB.ID, connB, chatID, "Hello from Client B", registerResponseB.Salt, t)
 	t.Log("Client B sent a message")
+	if ack := readAcknowledgment(connB, t); ack.Type != "ack" || ack.MessageID == 0 {
+		t.Fatalf("Client B received unexpected acknowledgment: %+v", ack)
+	}
 
 	// Client A reads the message
 	msg = readMessage(connA, t)
@@ -95,4 +180,10 @@ func TestTwoClientsMessageExchange(t *testing.T) {
 	if msg.Text != "Hello from Client B" {
 		t.Fatalf("Client A received incorrect message: %s", msg.Text)
 	}
+
+	// Errors carry the ID of the rejected frame as well
+	writeFrame(connA, "message", "malformed", "not a message", t)
+	if ack := readAcknowledgment(connA, t); ack.Type != "error" || ack.ID != "malformed" {
+		t.Fatalf("Client A received unexpected error: %+v", ack)
+	}
 }